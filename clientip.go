@@ -0,0 +1,136 @@
+package zerver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HEADER_FORWARDED    = "Forwarded"
+	HEADER_FORWARDEDFOR = "X-Forwarded-For"
+)
+
+// TrustedProxies is a list of proxy networks whose forwarding headers are trusted
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parse CIDRs or single IPs of trusted proxies, a single
+// IPv4 address(include IPv4-mapped IPv6 such as ::ffff:10.0.0.1) match only
+// itself
+func ParseTrustedProxies(addrs ...string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.IndexByte(addr, '/') >= 0 {
+			_, network, err := net.ParseCIDR(addr)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, network)
+			continue
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: addr}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		bits := len(ip) * 8
+		proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return proxies, nil
+}
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP return the canonical client ip of request, forwarding headers
+// are only used if the peer is a trusted proxy. The Forwarded header(RFC 7239)
+// is preferred, then X-Forwarded-For, X-Real-IP. Addresses in the chain are
+// checked from right to left, the first one isn't trusted proxy is the client.
+func (t TrustedProxies) ClientIP(requ *http.Request) string {
+	ip := ParseIP(requ.RemoteAddr)
+	if ip == nil {
+		return requ.RemoteAddr
+	}
+	if !t.Contains(ip) {
+		return canonicalIP(ip)
+	}
+
+	chain := forwardedFor(requ.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := ParseIP(chain[i])
+		if hop == nil { // obfuscated or invalid, can't go further
+			break
+		}
+
+		ip = hop
+		if !t.Contains(ip) {
+			break
+		}
+	}
+
+	return canonicalIP(ip)
+}
+
+// forwardedFor return the address chain from forwarding headers
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	if values := header[HEADER_FORWARDED]; len(values) != 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+						chain = append(chain, strings.Trim(pair[4:], `"`))
+					}
+				}
+			}
+		}
+		return chain
+	}
+
+	if values := header[HEADER_FORWARDEDFOR]; len(values) != 0 {
+		for _, value := range values {
+			for _, addr := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+		return chain
+	}
+
+	if addr := header.Get(HEADER_REALIP); addr != "" {
+		chain = append(chain, strings.TrimSpace(addr))
+	}
+	return chain
+}
+
+// ParseIP parse ip from address in forms of "ip", "ip:port", "[ipv6]" and
+// "[ipv6]:port", nil is returned if it's invalid
+func ParseIP(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return net.ParseIP(addr[1 : len(addr)-1])
+	}
+	return nil
+}
+
+func canonicalIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
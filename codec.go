@@ -0,0 +1,374 @@
+package zerver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cosiner/gohper/encoding"
+)
+
+const (
+	// Media types
+	MEDIATYPE_JSON    = "application/json"
+	MEDIATYPE_XML     = "application/xml"
+	MEDIATYPE_FORM    = CONTENTTYPE_FORM
+	MEDIATYPE_MSGPACK = "application/msgpack" // no builtin codec, register one with a msgpack library
+)
+
+var (
+	ErrNotAcceptable        = statusError{http.StatusNotAcceptable, "no acceptable media type"}
+	ErrUnsupportedMediaType = statusError{http.StatusUnsupportedMediaType, "unsupported media type"}
+)
+
+type (
+	// statusError carry a http status code, it's compatible with httperrs.Error
+	statusError struct {
+		code int
+		msg  string
+	}
+
+	// Codecs is a registry of codecs keyed by media type, the first registered
+	// codec is the default one used when client has no preference.
+	// It's not safe for concurrent registering, register codecs before server start.
+	Codecs struct {
+		types  []string
+		codecs []encoding.Codec
+	}
+
+	// EncodeChecker is implemented by codecs only support some types of values,
+	// such as FormCodec, they are skipped by negotiation for other values
+	EncodeChecker interface {
+		CanEncode(v interface{}) bool
+	}
+
+	acceptRange struct {
+		typ, sub string
+		q        float64
+	}
+)
+
+func (e statusError) Error() string {
+	return e.msg
+}
+
+func (e statusError) Code() int {
+	return e.code
+}
+
+// NewCodecs create a codec registry with JSON, XML and urlencoded form codecs,
+// the json codec is the default. Other codecs such as msgpack can be added by
+// Register with a third-party library.
+func NewCodecs(json encoding.Codec) *Codecs {
+	if json == nil {
+		json = encoding.JSON
+	}
+
+	c := &Codecs{}
+	c.Register(MEDIATYPE_JSON, json)
+	c.Register(MEDIATYPE_XML, XMLCodec{})
+	c.Register("text/xml", XMLCodec{})
+	c.Register(MEDIATYPE_FORM, FormCodec{})
+	return c
+}
+
+// Register add a codec for media type, or replace the exist one.
+func (c *Codecs) Register(mediaType string, codec encoding.Codec) {
+	mediaType = parseMediaType(mediaType)
+	for i, typ := range c.types {
+		if typ == mediaType {
+			c.codecs[i] = codec
+			return
+		}
+	}
+
+	c.types = append(c.types, mediaType)
+	c.codecs = append(c.codecs, codec)
+}
+
+// Default return the default media type and codec
+func (c *Codecs) Default() (string, encoding.Codec) {
+	if len(c.types) == 0 {
+		return "", nil
+	}
+	return c.types[0], c.codecs[0]
+}
+
+// Get return codec for the content type, parameters such as charset are ignored
+func (c *Codecs) Get(contentType string) encoding.Codec {
+	mediaType := parseMediaType(contentType)
+	for i, typ := range c.types {
+		if typ == mediaType {
+			return c.codecs[i]
+		}
+	}
+	return nil
+}
+
+// Negotiate select the best codec for the Accept header value by q-values,
+// codecs implement EncodeChecker and can't encode v are skipped. If accept is
+// empty, the first codec can encode v is returned, if there is no acceptable
+// codec, nil is returned
+func (c *Codecs) Negotiate(accept string, v interface{}) (string, encoding.Codec) {
+	var ranges []acceptRange
+	if strings.TrimSpace(accept) != "" {
+		ranges = parseAccept(accept)
+	}
+
+	best, bestQ := -1, 0.0
+	for i, typ := range c.types {
+		if !canEncode(c.codecs[i], v) {
+			continue
+		}
+		if ranges == nil {
+			best = i
+			break
+		}
+		if q := quality(ranges, typ); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return "", nil
+	}
+	return c.types[best], c.codecs[best]
+}
+
+func canEncode(codec encoding.Codec, v interface{}) bool {
+	checker, is := codec.(EncodeChecker)
+	return !is || checker.CanEncode(v)
+}
+
+// quality return the q-value of most specific range match the media type
+func quality(ranges []acceptRange, mediaType string) float64 {
+	typ, sub := splitMediaType(mediaType)
+
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.typ == typ && r.sub == sub:
+			s = 2
+		case r.typ == typ && r.sub == "*":
+			s = 1
+		case r.typ == "*" && r.sub == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// parseAccept parse Accept header value to media ranges
+func parseAccept(accept string) []acceptRange {
+	parts := strings.Split(accept, ",")
+	ranges := make([]acceptRange, 0, len(parts))
+	for _, part := range parts {
+		params := strings.Split(part, ";")
+		typ, sub := splitMediaType(params[0])
+		if typ == "" {
+			continue
+		}
+
+		r := acceptRange{typ: typ, sub: sub, q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q >= 0 && q <= 1 {
+					r.q = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// AcceptEncoding select the best supported encoding by q-values of the
+// Accept-Encoding header value, earlier one is preferred if q-values are
+// equal, "*" match encodings not listed, empty if nothing is acceptable.
+func AcceptEncoding(header string, supported ...string) string {
+	qs := make([]float64, len(supported))
+	for i := range qs {
+		qs[i] = -1
+	}
+	anyQ := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = ENCODING_GZIP
+		}
+		if name == "*" {
+			anyQ = q
+			continue
+		}
+		for i, s := range supported {
+			if s == name {
+				qs[i] = q
+			}
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for i, q := range qs {
+		if q < 0 {
+			q = anyQ
+		}
+		if q > bestQ {
+			best, bestQ = supported[i], q
+		}
+	}
+	return best
+}
+
+// parseMediaType trim parameters and spaces of content type, and make it lower case
+func parseMediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// isTextMediaType report whether charset parameter apply to the media type
+func isTextMediaType(mediaType string) bool {
+	typ, sub := splitMediaType(mediaType)
+	return typ == "text" || sub == "json" || sub == "xml" ||
+		strings.HasSuffix(sub, "+json") || strings.HasSuffix(sub, "+xml")
+}
+
+func splitMediaType(mediaType string) (string, string) {
+	mediaType = parseMediaType(mediaType)
+	i := strings.IndexByte(mediaType, '/')
+	if i <= 0 || i == len(mediaType)-1 {
+		if mediaType == "*" {
+			return "*", "*"
+		}
+		return "", ""
+	}
+	return mediaType[:i], mediaType[i+1:]
+}
+
+// XMLCodec is a codec use standard encoding/xml package
+type XMLCodec struct{}
+
+func (XMLCodec) Encode(w io.Writer, v interface{}) error {
+	return xml.NewEncoder(w).Encode(v)
+}
+
+func (XMLCodec) Decode(r io.Reader, v interface{}) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+func (XMLCodec) Marshal(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (XMLCodec) Unmarshal(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+// FormCodec encode/decode urlencoded form, only url.Values, map[string]string and
+// map[string][]string are supported
+type FormCodec struct{}
+
+const _FORM_SUPPORTED = "form codec only support url.Values, map[string]string and map[string][]string"
+
+var (
+	// errFormValue is client error of decoding, errFormEncode is server error
+	errFormValue  = statusError{http.StatusBadRequest, _FORM_SUPPORTED}
+	errFormEncode = statusError{http.StatusInternalServerError, _FORM_SUPPORTED}
+)
+
+func (FormCodec) Encode(w io.Writer, v interface{}) error {
+	bs, err := FormCodec{}.Marshal(v)
+	if err == nil {
+		_, err = w.Write(bs)
+	}
+	return err
+}
+
+func (FormCodec) Decode(r io.Reader, v interface{}) error {
+	bs, err := ioutil.ReadAll(r)
+	if err == nil {
+		err = FormCodec{}.Unmarshal(bs, v)
+	}
+	return err
+}
+
+// CanEncode report whether v is one of the supported types
+func (FormCodec) CanEncode(v interface{}) bool {
+	switch v.(type) {
+	case url.Values, *url.Values, map[string][]string, map[string]string:
+		return true
+	}
+	return false
+}
+
+func (FormCodec) Marshal(v interface{}) ([]byte, error) {
+	var vals url.Values
+	switch v := v.(type) {
+	case url.Values:
+		vals = v
+	case *url.Values:
+		vals = *v
+	case map[string][]string:
+		vals = v
+	case map[string]string:
+		vals = make(url.Values, len(v))
+		for k, s := range v {
+			vals.Set(k, s)
+		}
+	default:
+		return nil, errFormEncode
+	}
+	return []byte(vals.Encode()), nil
+}
+
+func (FormCodec) Unmarshal(data []byte, v interface{}) error {
+	vals, err := url.ParseQuery(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case *url.Values:
+		*v = vals
+	case url.Values:
+		for k, s := range vals {
+			v[k] = s
+		}
+	case *map[string][]string:
+		*v = vals
+	case map[string][]string:
+		for k, s := range vals {
+			v[k] = s
+		}
+	case map[string]string:
+		for k := range vals {
+			v[k] = vals.Get(k)
+		}
+	default:
+		return errFormValue
+	}
+	return nil
+}
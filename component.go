@@ -43,6 +43,7 @@ type (
 		StartTask(path string, value interface{})
 		Component(name string) (interface{}, error)
 		Codec() encoding.Codec
+		Codecs() *Codecs
 		Logger() *log.Logger
 	}
 
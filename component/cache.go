@@ -0,0 +1,278 @@
+package component
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	CACHE = "Cache"
+)
+
+type (
+	// CachedResponse is a response stored by filter.Cache. An entry only has
+	// Vary is the index of variants, variants are stored under other keys.
+	CachedResponse struct {
+		Status     int         `json:"status,omitempty"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       []byte      `json:"body,omitempty"`
+		Vary       []string    `json:"vary,omitempty"`
+		Stored     time.Time   `json:"stored"`
+		Expires    time.Time   `json:"expires"`    // fresh until
+		StaleUntil time.Time   `json:"staleUntil"` // served while revalidating until
+	}
+
+	// CacheStore store cached responses, keys start with request path followed
+	// by '?', prefix of Purge is matched on path segment boundary, so
+	// Purge("/articles") remove responses of "/articles" and "/articles/1",
+	// but not "/articles-old".
+	//
+	// Register it as component CACHE to share it between filter.Cache, handlers
+	// and tasks.
+	CacheStore interface {
+		zerver.Component
+		// Get return nil and nil error if key is absent or expired, the returned
+		// response must not be modified
+		Get(key string) (*CachedResponse, error)
+		Set(key string, resp *CachedResponse, ttl time.Duration) error
+		// Purge remove entries whose key has the prefix on path segment
+		// boundary, return the count
+		Purge(prefix string) (int, error)
+	}
+
+	// MemCacheStore is a LRU store in memory, the size of entry is counted by
+	// key, body and headers
+	MemCacheStore struct {
+		MaxEntries int   // default 10000
+		MaxBytes   int64 // default 64M
+
+		entries map[string]*list.Element
+		lru     *list.List
+		size    int64
+		lock    sync.Mutex
+	}
+
+	memCacheEntry struct {
+		key    string
+		resp   *CachedResponse
+		size   int64
+		expire time.Time
+	}
+
+	// RedisCacheStore store responses in component.Redis as json, the redis
+	// component must implements RedisCacheCommands, such as component.Redis
+	// with RedisOption.Do
+	RedisCacheStore struct {
+		Prefix    string // default "Cache:"
+		ScanCount int    // keys scanned and deleted per batch by Purge, default 100
+		store     RedisCacheCommands
+	}
+
+	// RedisCacheCommands is the commands RedisCacheStore required, nil and nil
+	// error is returned by GetBytes if key is absent. Scan is only used by Purge.
+	RedisCacheCommands interface {
+		GetBytes(key string) ([]byte, error)
+		SetWithExpire(key string, value []byte, seconds int) error
+		Del(keys ...string) error
+		Scan(cursor uint64, match string, count int) (next uint64, keys []string, err error)
+	}
+)
+
+// PurgeCache purge responses of registered component CACHE by key prefix, it's
+// available for handlers(req is Env) and tasks
+func PurgeCache(env zerver.Env, prefix string) (int, error) {
+	comp, err := env.Component(CACHE)
+	if err != nil {
+		return 0, err
+	}
+	store, is := comp.(CacheStore)
+	if !is {
+		return 0, errors.Err("component " + CACHE + " is not a CacheStore")
+	}
+	return store.Purge(prefix)
+}
+
+func (r *CachedResponse) size() int64 {
+	n := int64(len(r.Body))
+	for k, v := range r.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	for _, v := range r.Vary {
+		n += int64(len(v))
+	}
+	return n
+}
+
+func (m *MemCacheStore) Init(zerver.Env) error {
+	defval.Int(&m.MaxEntries, 10000)
+	if m.MaxBytes <= 0 {
+		m.MaxBytes = 64 << 20
+	}
+	m.entries = make(map[string]*list.Element)
+	m.lru = list.New()
+	m.size = 0
+	return nil
+}
+
+func (m *MemCacheStore) Destroy() {}
+
+func (m *MemCacheStore) remove(elem *list.Element) {
+	e := m.lru.Remove(elem).(*memCacheEntry)
+	delete(m.entries, e.key)
+	m.size -= e.size
+}
+
+func (m *MemCacheStore) Get(key string) (*CachedResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	elem, has := m.entries[key]
+	if !has {
+		return nil, nil
+	}
+	e := elem.Value.(*memCacheEntry)
+	if time.Now().After(e.expire) {
+		m.remove(elem)
+		return nil, nil
+	}
+	m.lru.MoveToFront(elem)
+	return e.resp, nil
+}
+
+func (m *MemCacheStore) Set(key string, resp *CachedResponse, ttl time.Duration) error {
+	e := &memCacheEntry{
+		key:    key,
+		resp:   resp,
+		size:   int64(len(key)) + resp.size(),
+		expire: time.Now().Add(ttl),
+	}
+
+	m.lock.Lock()
+	if elem, has := m.entries[key]; has {
+		m.remove(elem)
+	}
+	if e.size > m.MaxBytes { // old response is outdated, but new one is too large
+		m.lock.Unlock()
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(e)
+	m.size += e.size
+	for m.lru.Len() > m.MaxEntries || m.size > m.MaxBytes {
+		m.remove(m.lru.Back())
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// hasKeyPrefix report whether key has the prefix on path segment boundary,
+// the path in key is followed by '?', prefix end with '/' or '?' is matched as is
+func hasKeyPrefix(key, prefix string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	if len(key) == len(prefix) || strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, "?") {
+		return true
+	}
+	c := key[len(prefix)]
+	return c == '/' || c == '?'
+}
+
+func (m *MemCacheStore) Purge(prefix string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var n int
+	for key, elem := range m.entries {
+		if hasKeyPrefix(key, prefix) {
+			m.remove(elem)
+			n++
+		}
+	}
+	return n, nil
+}
+
+var _ RedisCacheCommands = (*Redis)(nil)
+
+func (r *RedisCacheStore) Init(env zerver.Env) error {
+	rd, err := env.Component(REDIS)
+	if err != nil {
+		return err
+	}
+
+	store, is := rd.(RedisCacheCommands)
+	if !is {
+		return errors.Err("redis component doesn't support GetBytes, SetWithExpire, Del and Scan")
+	}
+	r.store = store
+	defval.String(&r.Prefix, "Cache:")
+	defval.Int(&r.ScanCount, 100)
+	return nil
+}
+
+func (r *RedisCacheStore) Destroy() {
+	r.store = nil
+}
+
+func (r *RedisCacheStore) Get(key string) (*CachedResponse, error) {
+	data, err := r.store.GetBytes(r.Prefix + key)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	var resp CachedResponse
+	return &resp, json.Unmarshal(data, &resp)
+}
+
+func (r *RedisCacheStore) Set(key string, resp *CachedResponse, ttl time.Duration) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	secs := int((ttl + time.Second - 1) / time.Second)
+	return r.store.SetWithExpire(r.Prefix+key, data, secs)
+}
+
+// redisGlobEscaper escape special characters of redis MATCH pattern
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Purge iterate keys by SCAN and delete them in batches, so redis isn't
+// blocked as KEYS. Keys returned more than once by SCAN are counted once.
+func (r *RedisCacheStore) Purge(prefix string) (int, error) {
+	match := redisGlobEscaper.Replace(r.Prefix+prefix) + "*"
+	deleted := make(map[string]bool)
+	var cursor uint64
+	for {
+		next, scanned, err := r.store.Scan(cursor, match, r.ScanCount)
+		if err != nil {
+			return len(deleted), err
+		}
+		keys := scanned[:0]
+		for _, key := range scanned {
+			if hasKeyPrefix(strings.TrimPrefix(key, r.Prefix), prefix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) != 0 {
+			if err = r.store.Del(keys...); err != nil {
+				return len(deleted), err
+			}
+			for _, key := range keys {
+				deleted[key] = true
+			}
+		}
+		if next == 0 {
+			return len(deleted), nil
+		}
+		cursor = next
+	}
+}
@@ -1,24 +1,51 @@
 package component
 
 import (
+	"strconv"
+
+	"github.com/cosiner/gohper/encoding"
+	"github.com/cosiner/gohper/errors"
 	"github.com/cosiner/kv"
 	"github.com/cosiner/zerver"
-	"github.com/cosiner/gohper/encoding"
 )
 
 const (
 	REDIS = "Redis"
+
+	ErrRedisConn  = errors.Err("RedisOption.Do is not set, it's required by redis stores")
+	ErrRedisReply = errors.Err("unexpected redis reply")
 )
 
 type (
 	RedisOption struct {
 		Option kv.RedisOption
 		Codec  encoding.Codec
+		// Do execute commands of redis stores such as RedisRateLimitStore and
+		// RedisSessionStore, they don't work without it
+		Do RedisConnFunc
 	}
 
+	// Redis is the kv store, it also provide commands required by redis stores
+	// through RedisOption.Do
 	Redis struct {
 		kv.Store
+
+		do RedisConnFunc
 	}
+
+	// RedisConnFunc execute a redis command. It's called concurrently by all
+	// requests, so it must get a connection from pool for each call and release
+	// it after, a single connection such as redis.Conn of redigo can't be used:
+	//
+	//	func(cmd string, args ...interface{}) (interface{}, error) {
+	//		conn := pool.Get()
+	//		defer conn.Close()
+	//		return conn.Do(cmd, args...)
+	//	}
+	//
+	// Replies are redigo style: bulk string is []byte or string, integer is
+	// int64, array is []interface{}, nil reply is nil.
+	RedisConnFunc func(cmd string, args ...interface{}) (interface{}, error)
 )
 
 func NewRedis() *Redis {
@@ -34,9 +61,11 @@ func (r *Redis) Init(env zerver.Env) error {
 	case *RedisOption:
 		opt = t.Option
 		codec = t.Codec
+		r.do = t.Do
 	case RedisOption:
 		opt = t.Option
 		codec = t.Codec
+		r.do = t.Do
 	default:
 		opt = t
 	}
@@ -47,3 +76,123 @@ func (r *Redis) Init(env zerver.Env) error {
 
 func (r *Redis) Destroy() {
 }
+
+// Do execute a redis command by RedisOption.Do
+func (r *Redis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if r.do == nil {
+		return nil, ErrRedisConn
+	}
+	return r.do(cmd, args...)
+}
+
+func redisBytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch reply := reply.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return reply, nil
+	case string:
+		return []byte(reply), nil
+	}
+	return nil, ErrRedisReply
+}
+
+func redisInt(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply := reply.(type) {
+	case int64:
+		return reply, nil
+	case []byte:
+		return strconv.ParseInt(string(reply), 10, 64)
+	case string:
+		return strconv.ParseInt(reply, 10, 64)
+	}
+	return 0, ErrRedisReply
+}
+
+func redisStrings(reply interface{}) ([]string, error) {
+	items, is := reply.([]interface{})
+	if !is {
+		return nil, ErrRedisReply
+	}
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		bs, err := redisBytes(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, string(bs))
+	}
+	return strs, nil
+}
+
+// GetBytes return nil and nil error if key is absent
+func (r *Redis) GetBytes(key string) ([]byte, error) {
+	return redisBytes(r.Do("GET", key))
+}
+
+// GetString return empty string and nil error if key is absent
+func (r *Redis) GetString(key string) (string, error) {
+	bs, err := redisBytes(r.Do("GET", key))
+	return string(bs), err
+}
+
+func (r *Redis) SetWithExpire(key string, value []byte, seconds int) error {
+	_, err := r.Do("SET", key, value, "EX", seconds)
+	return err
+}
+
+// SetNX set value only if key is absent, return whether it's set
+func (r *Redis) SetNX(key string, value []byte, seconds int) (bool, error) {
+	reply, err := redisBytes(r.Do("SET", key, value, "EX", seconds, "NX"))
+	return reply != nil, err
+}
+
+func (r *Redis) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	_, err := r.Do("DEL", args...)
+	return err
+}
+
+func (r *Redis) Incr(key string) (int64, error) {
+	return redisInt(r.Do("INCR", key))
+}
+
+func (r *Redis) Expire(key string, seconds int) error {
+	_, err := r.Do("EXPIRE", key, seconds)
+	return err
+}
+
+// Scan iterate keys match pattern, it return next cursor and keys, iteration
+// is finished if next cursor is 0
+func (r *Redis) Scan(cursor uint64, match string, count int) (uint64, []string, error) {
+	reply, err := r.Do("SCAN", strconv.FormatUint(cursor, 10), "MATCH", match, "COUNT", count)
+	if err != nil {
+		return 0, nil, err
+	}
+	values, is := reply.([]interface{})
+	if !is || len(values) != 2 {
+		return 0, nil, ErrRedisReply
+	}
+	bs, err := redisBytes(values[0], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(string(bs), 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	keys, err := redisStrings(values[1])
+	return next, keys, err
+}
@@ -0,0 +1,166 @@
+package component
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/time2"
+	"github.com/cosiner/gohper/unsafe2"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	SECURECOOKIE = "SecureCookie"
+
+	ErrCookieInvalid = errors.Err("cookie value is invalid")
+	ErrCookieExpired = errors.Err("cookie value is expired")
+)
+
+// SecureCookie sign cookie value with HMAC, and encrypt it with AES-GCM
+// if BlockKeys is not empty.
+//
+// Keys are rotatable, the first key is used for encoding, all keys are
+// tried for decoding, so add new key at front and remove the old one later.
+type SecureCookie struct {
+	HashKeys   []string         // secret keys for signing, at least one
+	BlockKeys  []string         // AES keys, length must be 16, 24 or 32, empty to disable encryption
+	HashMethod func() hash.Hash // hash method for signing data, default sha256
+	MaxAge     int64            // seconds, values older than it is expired, 0 means no limit
+
+	signer hmacSigner
+	blocks []cipher.AEAD
+}
+
+func (s *SecureCookie) Init(zerver.Env) error {
+	if len(s.HashKeys) == 0 {
+		return errors.Err("secure cookie hash keys can't be empty")
+	}
+	if s.HashMethod == nil {
+		s.HashMethod = sha256.New
+	}
+	s.signer = hmacSigner{keys: s.HashKeys, method: s.HashMethod}
+
+	s.blocks = make([]cipher.AEAD, 0, len(s.BlockKeys))
+	for _, key := range s.BlockKeys {
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		s.blocks = append(s.blocks, gcm)
+	}
+
+	return nil
+}
+
+func (s *SecureCookie) Destroy() {}
+
+// Encode create a signed(and encrypted) value for named cookie, the name is
+// also signed to prevent value from being used for another cookie
+func (s *SecureCookie) Encode(name string, value []byte) (string, error) {
+	data := make([]byte, 8+len(value)) // timestamp+value
+	binary.BigEndian.PutUint64(data, uint64(time2.Now().Unix()))
+	copy(data[8:], value)
+
+	if len(s.blocks) != 0 {
+		gcm := s.blocks[0]
+		nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		data = gcm.Seal(nonce, nonce, data, unsafe2.Bytes(name))
+	}
+
+	data = s.signer.sign(data, unsafe2.Bytes(name), data) // data+signature
+
+	return _ENCODING.EncodeToString(data), nil
+}
+
+// Decode verify and decrypt the value of named cookie
+func (s *SecureCookie) Decode(name, value string) ([]byte, error) {
+	data, err := _ENCODING.DecodeString(value)
+	if err != nil {
+		return nil, ErrCookieInvalid
+	}
+
+	data = s.signer.verify(unsafe2.Bytes(name), data)
+	if data == nil {
+		return nil, ErrCookieInvalid
+	}
+
+	if len(s.blocks) != 0 {
+		data = s.decrypt(name, data)
+		if data == nil {
+			return nil, ErrCookieInvalid
+		}
+	}
+
+	if len(data) < 8 {
+		return nil, ErrCookieInvalid
+	}
+	t := int64(binary.BigEndian.Uint64(data))
+	if s.MaxAge > 0 && t+s.MaxAge < time2.Now().Unix() {
+		return nil, ErrCookieExpired
+	}
+
+	return data[8:], nil
+}
+
+func (s *SecureCookie) decrypt(name string, data []byte) []byte {
+	for _, gcm := range s.blocks {
+		n := gcm.NonceSize()
+		if len(data) < n {
+			continue
+		}
+
+		plain, err := gcm.Open(nil, data[:n], data[n:], unsafe2.Bytes(name))
+		if err == nil {
+			return plain
+		}
+	}
+
+	return nil
+}
+
+// SetCookie encode value and set it as cookie, if c is nil, the cookie is
+// created by zerver.NewCookie, otherwise it's used as template
+func (s *SecureCookie) SetCookie(resp zerver.Response, c *http.Cookie, name string, value []byte) error {
+	encoded, err := s.Encode(name, value)
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		c = zerver.NewCookie(name, encoded)
+	} else {
+		cookie := *c
+		cookie.Name, cookie.Value = name, encoded
+		c = &cookie
+	}
+	if s.MaxAge > 0 && c.MaxAge == 0 && c.Expires.IsZero() {
+		c.MaxAge = int(s.MaxAge)
+	}
+
+	resp.SetCookie(c)
+	return nil
+}
+
+// Cookie get the named cookie from request and decode it
+func (s *SecureCookie) Cookie(req zerver.Request, name string) ([]byte, error) {
+	c, err := req.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Decode(name, c.Value)
+}
@@ -0,0 +1,481 @@
+package component
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	SESSION = "Session"
+
+	_SESSION_COOKIE     = "session"
+	_SESSION_TOUCH      = time.Minute // interval to refresh access time of clean session
+	_SESSION_COOKIE_MAX = 4000
+
+	ErrSessionTooLarge = errors.Err("session is too large for cookie")
+)
+
+type (
+	// SessionStore store encoded sessions
+	SessionStore interface {
+		zerver.Component
+		// Load return encoded session of cookie value, nil if it's absent
+		Load(value string) ([]byte, error)
+		// Save store encoded session, return the cookie value
+		Save(id string, data []byte, ttl time.Duration) (string, error)
+		Delete(id string) error
+	}
+
+	// Sessions load session from cookie and save it before response header is
+	// written if it's changed, it's used by filter.Session.
+	//
+	// Session values are encoded by encoding/gob, custom types stored in
+	// session must be registered by gob.Register before used.
+	Sessions struct {
+		Store      SessionStore // default MemSessionStore
+		CookieName string       // default "session"
+		Domain     string
+		Path       string // default "/"
+
+		IdleTimeout     time.Duration // default 30 minutes
+		AbsoluteTimeout time.Duration // default 24 hours
+
+		log *log.Logger
+	}
+
+	sessionData struct {
+		ID       string
+		Created  int64
+		Accessed int64
+		Values   map[string]interface{}
+		Flashes  map[string][]interface{}
+	}
+
+	session struct {
+		data        sessionData
+		dirty       bool
+		isNew       bool
+		oldID       string // id before regenerate, removed on commit
+		invalidated bool
+	}
+
+	// sessionWriter commit session before header is written
+	sessionWriter struct {
+		http.ResponseWriter
+		commit    func()
+		needClose bool
+	}
+
+	// MemSessionStore store sessions in memory
+	MemSessionStore struct {
+		CleanInterval time.Duration // default 1 minute
+
+		sessions map[string]memSession
+		lock     sync.RWMutex
+		stop     chan struct{}
+	}
+
+	memSession struct {
+		data   []byte
+		expire time.Time
+	}
+
+	// CookieSessionStore store session in cookie, signed(and encrypted) by
+	// SecureCookie, session must be small. Delete only remove the cookie, the
+	// old value is still valid until expired.
+	CookieSessionStore struct {
+		Cookie *SecureCookie
+		// cookie name the value is signed for, default Sessions.CookieName if
+		// it's the store of Sessions
+		CookieName string
+	}
+
+	// RedisSessionStore store sessions in component.Redis, the redis store
+	// must implements RedisSessionCommands, such as component.Redis with
+	// RedisOption.Do
+	RedisSessionStore struct {
+		Prefix string // default "Session:"
+		store  RedisSessionCommands
+	}
+
+	// RedisSessionCommands is the commands RedisSessionStore required, nil and
+	// nil error is returned by GetBytes if key is absent
+	RedisSessionCommands interface {
+		GetBytes(key string) ([]byte, error)
+		SetWithExpire(key string, value []byte, seconds int) error
+		Del(keys ...string) error
+	}
+)
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Sessions) Init(env zerver.Env) error {
+	defval.String(&s.CookieName, _SESSION_COOKIE)
+	defval.Nil(&s.Store, new(MemSessionStore))
+	if c, is := s.Store.(*CookieSessionStore); is {
+		defval.String(&c.CookieName, s.CookieName)
+	}
+	if err := s.Store.Init(env); err != nil {
+		return err
+	}
+	defval.String(&s.Path, "/")
+	if s.IdleTimeout <= 0 {
+		s.IdleTimeout = 30 * time.Minute
+	}
+	if s.AbsoluteTimeout <= 0 {
+		s.AbsoluteTimeout = 24 * time.Hour
+	}
+	s.log = log.Derive("Component", "Sessions")
+	return nil
+}
+
+func (s *Sessions) Destroy() {
+	s.Store.Destroy()
+}
+
+// load session of request, expired or undecodable session is deleted from store
+func (s *Sessions) load(req zerver.Request, now time.Time) *session {
+	if c, err := req.Cookie(s.CookieName); err == nil && c.Value != "" {
+		logger := req.Log().For(s.log)
+		data, err := s.Store.Load(c.Value)
+		if err != nil {
+			logger.Warn(log.M{"msg": "load session failed", "err": err.Error()})
+		} else if data != nil {
+			sess := &session{}
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(&sess.data)
+			if err == nil && !s.expired(&sess.data, now) {
+				return sess
+			}
+
+			id := c.Value
+			if err != nil {
+				logger.Warn(log.M{"msg": "decode session failed", "err": err.Error()})
+			} else {
+				id = sess.data.ID
+			}
+			if err = s.Store.Delete(id); err != nil {
+				logger.Warn(log.M{"msg": "delete session failed", "err": err.Error()})
+			}
+		}
+	}
+
+	return &session{
+		isNew: true,
+		data: sessionData{
+			ID:       newSessionID(),
+			Created:  now.Unix(),
+			Accessed: now.Unix(),
+		},
+	}
+}
+
+func (s *Sessions) expired(data *sessionData, now time.Time) bool {
+	return now.Sub(time.Unix(data.Accessed, 0)) > s.IdleTimeout ||
+		now.Sub(time.Unix(data.Created, 0)) > s.AbsoluteTimeout
+}
+
+// Start load session of request, store it to request attribute, the session
+// is saved before response header is written, call the returned commit function
+// after handler is done for response without any write.
+func (s *Sessions) Start(req zerver.Request, resp zerver.Response) (commit func()) {
+	now := time.Now()
+	sess := s.load(req, now)
+	req.SetAttr(zerver.ATTR_SESSION, sess)
+
+	var once sync.Once
+	commit = func() {
+		once.Do(func() {
+			s.commit(resp, sess, now)
+		})
+	}
+	resp.Wrap(func(w http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
+		return &sessionWriter{ResponseWriter: w, commit: commit, needClose: needClose}, true
+	})
+	return commit
+}
+
+func (s *Sessions) setCookie(resp zerver.Response, value string, maxAge int) {
+	c := zerver.NewCookie(s.CookieName, value)
+	c.Domain = s.Domain
+	c.Path = s.Path
+	c.MaxAge = maxAge
+	resp.SetCookie(c)
+}
+
+func (s *Sessions) commit(resp zerver.Response, sess *session, now time.Time) {
+	logger := resp.Log().For(s.log)
+	if sess.oldID != "" {
+		if err := s.Store.Delete(sess.oldID); err != nil {
+			logger.Warn(log.M{"msg": "delete session failed", "err": err.Error()})
+		}
+	}
+	if sess.invalidated {
+		if !sess.isNew {
+			s.setCookie(resp, "", -1)
+		}
+		return
+	}
+
+	// new session without values is not saved
+	if !sess.dirty && (sess.isNew || now.Sub(time.Unix(sess.data.Accessed, 0)) < _SESSION_TOUCH) {
+		return
+	}
+
+	sess.data.Accessed = now.Unix()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&sess.data); err != nil {
+		logger.Error(log.M{"msg": "encode session failed", "err": err.Error()})
+		return
+	}
+
+	ttl := s.AbsoluteTimeout - now.Sub(time.Unix(sess.data.Created, 0))
+	if ttl > s.IdleTimeout {
+		ttl = s.IdleTimeout
+	}
+	value, err := s.Store.Save(sess.data.ID, buf.Bytes(), ttl)
+	if err != nil {
+		logger.Error(log.M{"msg": "save session failed", "err": err.Error()})
+		return
+	}
+
+	maxAge := s.AbsoluteTimeout - now.Sub(time.Unix(sess.data.Created, 0))
+	s.setCookie(resp, value, int(maxAge/time.Second))
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	w.commit()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Flush() {
+	if flusher, is := w.ResponseWriter.(http.Flusher); is {
+		flusher.Flush()
+	}
+}
+
+func (w *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, is := w.ResponseWriter.(http.Hijacker)
+	if !is {
+		return nil, nil, zerver.ErrHijack
+	}
+	return hijacker.Hijack()
+}
+
+func (w *sessionWriter) Close() error {
+	if w.needClose {
+		return w.ResponseWriter.(io.Closer).Close()
+	}
+	return nil
+}
+
+// =============================================================================
+//
+//	Session
+//
+// =============================================================================
+func (s *session) ID() string {
+	return s.data.ID
+}
+
+func (s *session) Get(name string) interface{} {
+	return s.data.Values[name]
+}
+
+func (s *session) Set(name string, value interface{}) {
+	if s.data.Values == nil {
+		s.data.Values = make(map[string]interface{})
+	}
+	s.data.Values[name] = value
+	s.dirty = true
+}
+
+func (s *session) Delete(name string) {
+	if _, has := s.data.Values[name]; has {
+		delete(s.data.Values, name)
+		s.dirty = true
+	}
+}
+
+func (s *session) Flash(name string, value interface{}) {
+	if s.data.Flashes == nil {
+		s.data.Flashes = make(map[string][]interface{})
+	}
+	s.data.Flashes[name] = append(s.data.Flashes[name], value)
+	s.dirty = true
+}
+
+func (s *session) Flashes(name string) []interface{} {
+	flashes, has := s.data.Flashes[name]
+	if has {
+		delete(s.data.Flashes, name)
+		s.dirty = true
+	}
+	return flashes
+}
+
+func (s *session) Regenerate() {
+	if !s.isNew && s.oldID == "" {
+		s.oldID = s.data.ID
+	}
+	s.data.ID = newSessionID()
+	s.dirty = true
+}
+
+func (s *session) Invalidate() {
+	if !s.isNew && s.oldID == "" {
+		s.oldID = s.data.ID
+	}
+	s.data.Values = nil
+	s.data.Flashes = nil
+	s.invalidated = true
+}
+
+// =============================================================================
+//
+//	Stores
+//
+// =============================================================================
+func (m *MemSessionStore) Init(zerver.Env) error {
+	if m.CleanInterval <= 0 {
+		m.CleanInterval = time.Minute
+	}
+	m.sessions = make(map[string]memSession)
+	m.stop = make(chan struct{})
+	go m.clean()
+	return nil
+}
+
+func (m *MemSessionStore) Destroy() {
+	close(m.stop)
+}
+
+func (m *MemSessionStore) clean() {
+	ticker := time.NewTicker(m.CleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			for id, s := range m.sessions {
+				if now.After(s.expire) {
+					delete(m.sessions, id)
+				}
+			}
+			m.lock.Unlock()
+		}
+	}
+}
+
+func (m *MemSessionStore) Load(id string) ([]byte, error) {
+	m.lock.RLock()
+	s, has := m.sessions[id]
+	m.lock.RUnlock()
+	if !has || time.Now().After(s.expire) {
+		return nil, nil
+	}
+	return s.data, nil
+}
+
+func (m *MemSessionStore) Save(id string, data []byte, ttl time.Duration) (string, error) {
+	m.lock.Lock()
+	m.sessions[id] = memSession{data: data, expire: time.Now().Add(ttl)}
+	m.lock.Unlock()
+	return id, nil
+}
+
+func (m *MemSessionStore) Delete(id string) error {
+	m.lock.Lock()
+	delete(m.sessions, id)
+	m.lock.Unlock()
+	return nil
+}
+
+func (c *CookieSessionStore) Init(env zerver.Env) error {
+	defval.String(&c.CookieName, _SESSION_COOKIE)
+	if c.Cookie == nil {
+		sc, err := env.Component(SECURECOOKIE)
+		if err != nil {
+			return err
+		}
+		c.Cookie = sc.(*SecureCookie)
+	}
+	return nil
+}
+
+func (c *CookieSessionStore) Destroy() {}
+
+func (c *CookieSessionStore) Load(value string) ([]byte, error) {
+	data, err := c.Cookie.Decode(c.CookieName, value)
+	if err == ErrCookieInvalid || err == ErrCookieExpired {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (c *CookieSessionStore) Save(id string, data []byte, ttl time.Duration) (string, error) {
+	value, err := c.Cookie.Encode(c.CookieName, data)
+	if err == nil && len(value) > _SESSION_COOKIE_MAX {
+		return "", ErrSessionTooLarge
+	}
+	return value, err
+}
+
+func (c *CookieSessionStore) Delete(string) error {
+	return nil
+}
+
+var _ RedisSessionCommands = (*Redis)(nil)
+
+func (r *RedisSessionStore) Init(env zerver.Env) error {
+	rd, err := env.Component(REDIS)
+	if err != nil {
+		return err
+	}
+
+	store, is := rd.(RedisSessionCommands)
+	if !is {
+		return errors.Err("redis component doesn't support GetBytes, SetWithExpire and Del")
+	}
+	r.store = store
+	defval.String(&r.Prefix, "Session:")
+	return nil
+}
+
+func (r *RedisSessionStore) Destroy() {
+	r.store = nil
+}
+
+func (r *RedisSessionStore) Load(id string) ([]byte, error) {
+	return r.store.GetBytes(r.Prefix + id)
+}
+
+func (r *RedisSessionStore) Save(id string, data []byte, ttl time.Duration) (string, error) {
+	secs := int((ttl + time.Second - 1) / time.Second)
+	return id, r.store.SetWithExpire(r.Prefix+id, data, secs)
+}
+
+func (r *RedisSessionStore) Delete(id string) error {
+	return r.store.Del(r.Prefix + id)
+}
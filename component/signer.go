@@ -0,0 +1,47 @@
+package component
+
+import (
+	"crypto/hmac"
+	"hash"
+
+	"github.com/cosiner/gohper/unsafe2"
+)
+
+// hmacSigner sign data with HMAC, it's shared by SecureCookie and Xsrf. The
+// first key is used for signing, all keys are tried for verifying.
+type hmacSigner struct {
+	keys   []string
+	method func() hash.Hash
+}
+
+func (s hmacSigner) size() int {
+	return s.method().Size()
+}
+
+// sign append signature of all data to dst
+func (s hmacSigner) sign(dst []byte, data ...[]byte) []byte {
+	h := hmac.New(s.method, unsafe2.Bytes(s.keys[0]))
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(dst)
+}
+
+// verify check the signature at the end of signed, prefix is signed together
+// but not carried. It return data without signature, or nil if it's invalid.
+func (s hmacSigner) verify(prefix, signed []byte) []byte {
+	for _, key := range s.keys {
+		h := hmac.New(s.method, unsafe2.Bytes(key))
+		sep := len(signed) - h.Size()
+		if sep < 0 {
+			continue
+		}
+
+		h.Write(prefix)
+		h.Write(signed[:sep])
+		if hmac.Equal(h.Sum(nil), signed[sep:]) {
+			return signed[:sep]
+		}
+	}
+	return nil
+}
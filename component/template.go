@@ -12,6 +12,10 @@ import (
 
 const (
 	TEMPLATE = "Template"
+
+	// ATTR_CSPNONCE is the request attribute of CSP nonce, it's set by
+	// filter.SecurityHeaders
+	ATTR_CSPNONCE = "CSPNonce"
 )
 
 type (
@@ -53,11 +57,16 @@ func (t *Template) Init(env zerver.Env) error {
 	}
 	o.init()
 
+	funcs := tmpl.FuncMap{"cspNonce": CSPNonce}
+	for name, fn := range o.FuncMap {
+		funcs[name] = fn
+	}
+
 	files, err := filenames(o.Path, o.Suffixes)
 	if err == nil {
 		_, err = (*tmpl.Template)(t).
 			Delims(o.DelimLeft, o.DelimRight).
-			Funcs(o.FuncMap).
+			Funcs(funcs).
 			ParseFiles(files...)
 	}
 
@@ -66,6 +75,14 @@ func (t *Template) Init(env zerver.Env) error {
 
 func (t *Template) Destroy() {}
 
+// CSPNonce return the CSP nonce of request, it's also available in templates
+// as function cspNonce, request must be passed in template data:
+// <script nonce="{{cspNonce .Request}}">
+func CSPNonce(req zerver.Request) string {
+	nonce, _ := req.Attr(ATTR_CSPNONCE).(string)
+	return nonce
+}
+
 func (t *Template) Render(w io.Writer, data interface{}) error {
 	return (*tmpl.Template)(t).Execute(w, data)
 }
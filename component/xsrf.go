@@ -1,8 +1,6 @@
 package component
 
 import (
-	"bytes"
-	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -11,7 +9,6 @@ import (
 
 	"github.com/cosiner/gohper/bytes2"
 	"github.com/cosiner/gohper/errors"
-	"github.com/cosiner/gohper/net2/http2"
 	"github.com/cosiner/gohper/time2"
 	"github.com/cosiner/gohper/unsafe2"
 	"github.com/cosiner/gohper/utils/defval"
@@ -50,7 +47,8 @@ type (
 
 		TokenInfo TokenInfo // marshal/unmarshal token info, default use jsonToken
 
-		log *log.Logger
+		signer hmacSigner
+		log    *log.Logger
 	}
 
 	TokenInfo interface {
@@ -86,6 +84,7 @@ func (x *Xsrf) Init(env zerver.Env) error {
 
 	defval.Int64(&x.Timeout, _DEF_XSRF_TIMEOUT)
 	defval.Nil(&x.HashMethod, sha256.New)
+	x.signer = hmacSigner{keys: []string{x.Secret}, method: x.HashMethod}
 	defval.String(&x.Error, "xsrf token is invalid or not found")
 
 	if x.UsePool {
@@ -117,12 +116,12 @@ func (x *Xsrf) Create(req zerver.Request, resp zerver.Response) {
 	defer x.Pool.Put(tokBytes)
 	err = resp.Send(Token{string(tokBytes)})
 	if err != nil {
-		x.log.Error(log.M{"msg":"send xsrf token", "err":err.Error()})
+		resp.Log().For(x.log).Error(log.M{"msg":"send xsrf token", "err":err.Error()})
 	}
 }
 
 func (x *Xsrf) CreateFor(req zerver.Request) ([]byte, error) {
-	bs, err := x.TokenInfo.Marshal(time2.Now().Unix(), http2.IpOfAddr(req.RemoteAddr()))
+	bs, err := x.TokenInfo.Marshal(time2.Now().Unix(), req.ClientIP())
 	if err == nil {
 		return x.sign(bs), nil
 	}
@@ -153,7 +152,10 @@ func (x *Xsrf) VerifyFor(req zerver.Request) bool {
 		if token == "" {
 			token = req.Vars().QueryVar(_XSRF_PARAM_NAME)
 			if token == "" {
-				return false
+				token = req.Vars().FormVar(_XSRF_PARAM_NAME)
+				if token == "" {
+					return false
+				}
 			}
 		}
 	}
@@ -164,28 +166,18 @@ func (x *Xsrf) VerifyFor(req zerver.Request) bool {
 		t, ip := x.TokenInfo.Unmarshal(data)
 		return t != -1 &&
 			t+x.Timeout >= time2.Now().Unix() &&
-			ip == http2.IpOfAddr(req.RemoteAddr())
+			ip == req.ClientIP()
 	}
 
 	return false
 }
 
-func (x *Xsrf) hash() hash.Hash {
-	return hmac.New(x.HashMethod, unsafe2.Bytes(x.Secret))
-}
-
 func (x *Xsrf) sign(data []byte) []byte {
-	hash := x.hash()
-	hash.Write(data)
-	signing := hash.Sum(nil)
-
-	bs := x.Pool.Get(len(data)+hash.Size(), false) // data+signature
-	buf := bytes.NewBuffer(bs)
-	buf.Write(data)
-	buf.Write(signing)
+	bs := x.Pool.Get(len(data)+x.signer.size(), false)
+	bs = x.signer.sign(append(bs[:0], data...), data) // data+signature
 
-	dst := x.Pool.Get(_ENCODING.EncodedLen(buf.Len()), true)
-	_ENCODING.Encode(dst, buf.Bytes())
+	dst := x.Pool.Get(_ENCODING.EncodedLen(len(bs)), true)
+	_ENCODING.Encode(dst, bs)
 	x.Pool.Put(bs)
 
 	return dst
@@ -195,17 +187,8 @@ func (x *Xsrf) verify(signing []byte) []byte {
 	dst := x.Pool.Get(_ENCODING.DecodedLen(len(signing)), true)
 	n, err := _ENCODING.Decode(dst, signing)
 	if err == nil {
-		dst = dst[:n]
-		hash := x.hash()
-
-		sep := len(dst) - hash.Size()
-		if sep > 0 {
-			data := dst[:sep]
-			hash.Write(data)
-
-			if bytes.Equal(hash.Sum(nil), dst[sep:]) {
-				return data
-			}
+		if data := x.signer.verify(nil, dst[:n]); len(data) != 0 {
+			return data
 		}
 	}
 
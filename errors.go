@@ -0,0 +1,48 @@
+package zerver
+
+import (
+	"net/http"
+	"strings"
+)
+
+type (
+	// FieldError is the error of a single request parameter
+	FieldError struct {
+		Field  string `json:"field"`
+		Source string `json:"in,omitempty"` // path, query, form, header or body
+		Error  string `json:"error"`
+	}
+
+	// FieldErrors aggregate errors of request parameters, it's an error with
+	// status code 400, compatible with httperrs.Error
+	FieldErrors []FieldError
+)
+
+// Add record an error of field
+func (e *FieldErrors) Add(source, field, err string) {
+	*e = append(*e, FieldError{
+		Field:  field,
+		Source: source,
+		Error:  err,
+	})
+}
+
+// Err return nil if there is no errors, otherwise the FieldErrors itself
+func (e FieldErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e FieldErrors) Error() string {
+	s := make([]string, len(e))
+	for i := range e {
+		s[i] = e[i].Field + ": " + e[i].Error
+	}
+	return "invalid parameters: " + strings.Join(s, "; ")
+}
+
+func (e FieldErrors) Code() int {
+	return http.StatusBadRequest
+}
@@ -0,0 +1,449 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/handle"
+)
+
+const (
+	ACCESSLOG_COMMON   = "common"
+	ACCESSLOG_COMBINED = "combined"
+	ACCESSLOG_JSON     = "json"
+
+	_CLF_TIME      = "02/Jan/2006:15:04:05 -0700"
+	_ROTATE_LAYOUT = "20060102-150405.000" // suffix of rotated files
+)
+
+// DefAccessLogFields is the default fields of json format
+var DefAccessLogFields = []string{
+	"time", "remote", "method", "url", "pattern", "status",
+	"bytesIn", "bytesOut", "latency", "ttfb", "requestId", "userAgent",
+}
+
+type (
+	// AccessLog write access log in Common/Combined Log Format or json.
+	//
+	// Fields of json format can be selected from: time, remote, host, method,
+	// url, path, query, proto, pattern, status, bytesIn, bytesOut, latency(ms),
+	// ttfb(ms), requestId, principal, userAgent, referer.
+	//
+	// Responses with status >= 400 are always logged, others are logged at
+	// SampleRate. Exclude is paths not logged, path end with '*' is matched
+	// by prefix, such as health checks.
+	AccessLog struct {
+		Format     string    // default ACCESSLOG_COMBINED
+		Fields     []string  // fields of json format, default DefAccessLogFields
+		Output     io.Writer // default os.Stdout, use RotatingFile for file, it's not closed by filter
+		SampleRate float64   // (0, 1], default 1
+		Exclude    []string
+
+		lock sync.Mutex
+		buf  bytes.Buffer
+	}
+
+	// RotatingFile is a file writer rotate by size, rotated file is named
+	// as filename.20060102-150405.000, a sequence such as "-1" is appended if
+	// it already exists, only MaxBackups old files are kept, other files are
+	// never removed
+	RotatingFile struct {
+		Filename   string
+		MaxSize    int64 // bytes, default 100M
+		MaxBackups int   // default 7, negative means keep all
+
+		fd   *os.File
+		size int64
+		lock sync.Mutex
+	}
+
+	rotatedFile struct {
+		name string
+		time time.Time
+		seq  int
+	}
+
+	accessEntry struct {
+		req      zerver.Request
+		start    time.Time
+		latency  time.Duration
+		ttfb     time.Duration
+		status   int
+		bytesIn  int64
+		bytesOut int64
+	}
+
+	countReader struct {
+		io.ReadCloser
+		n *int64
+	}
+
+	// accessWriter count bytes written and record time of first byte
+	accessWriter struct {
+		http.ResponseWriter
+		start     time.Time
+		ttfb      time.Duration
+		n         int64
+		needClose bool
+	}
+)
+
+func (r countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.ttfb == 0 {
+		w.ttfb = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(data []byte) (int, error) {
+	if w.ttfb == 0 {
+		w.ttfb = time.Since(w.start)
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if flusher, is := w.ResponseWriter.(http.Flusher); is {
+		flusher.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, is := w.ResponseWriter.(http.Hijacker)
+	if !is {
+		return nil, nil, zerver.ErrHijack
+	}
+	return hijacker.Hijack()
+}
+
+func (w *accessWriter) Close() error {
+	if w.needClose {
+		return w.ResponseWriter.(io.Closer).Close()
+	}
+	return nil
+}
+
+func (l *AccessLog) Init(zerver.Env) error {
+	if l.Format == "" {
+		l.Format = ACCESSLOG_COMBINED
+	}
+	switch l.Format {
+	case ACCESSLOG_COMMON, ACCESSLOG_COMBINED, ACCESSLOG_JSON:
+	default:
+		return errors.Err("unsupported access log format: " + l.Format)
+	}
+	if len(l.Fields) == 0 {
+		l.Fields = DefAccessLogFields
+	}
+	if l.Output == nil {
+		l.Output = os.Stdout
+	}
+	if l.SampleRate <= 0 || l.SampleRate > 1 {
+		l.SampleRate = 1
+	}
+	return nil
+}
+
+func (l *AccessLog) Destroy() {}
+
+func (l *AccessLog) excluded(path string) bool {
+	for _, e := range l.Exclude {
+		if strings.HasSuffix(e, "*") {
+			if strings.HasPrefix(path, e[:len(e)-1]) {
+				return true
+			}
+		} else if e == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AccessLog) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	if l.excluded(req.URL().Path) {
+		chain(req, resp)
+		return
+	}
+
+	e := accessEntry{req: req, start: time.Now()}
+	req.Wrap(func(requ *http.Request, needClose bool) (*http.Request, bool) {
+		if requ.Body != nil {
+			requ.Body = countReader{ReadCloser: requ.Body, n: &e.bytesIn}
+		}
+		return requ, needClose
+	})
+	var w *accessWriter
+	resp.Wrap(func(rw http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
+		w = &accessWriter{ResponseWriter: rw, start: e.start, needClose: needClose}
+		return w, true
+	})
+
+	chain(req, resp)
+
+	e.status = resp.StatusCode(0)
+	if e.status < http.StatusBadRequest && l.SampleRate < 1 && rand.Float64() >= l.SampleRate {
+		return
+	}
+	e.latency = time.Since(e.start)
+	e.ttfb = w.ttfb
+	if e.ttfb == 0 { // header is written after filter return
+		e.ttfb = e.latency
+	}
+	e.bytesOut = w.n
+
+	l.lock.Lock()
+	l.buf.Reset()
+	if l.Format == ACCESSLOG_JSON {
+		l.writeJSON(&e)
+	} else {
+		l.writeCLF(&e)
+	}
+	l.Output.Write(l.buf.Bytes())
+	l.lock.Unlock()
+}
+
+func requestID(req zerver.Request) string {
+	if id := req.CorrelationID(); id != "" {
+		return id
+	}
+	return req.GetHeader(handle.TraceIDHeader)
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// writeCLF write Common/Combined Log Format, bytes out is counted at writer,
+// so when response is compressed, it's the compressed size
+func (l *AccessLog) writeCLF(e *accessEntry) {
+	req := e.req
+	buf := &l.buf
+
+	buf.WriteString(req.ClientIP())
+	buf.WriteString(" - ")
+	buf.WriteString(clfField(Principal(req)))
+	buf.WriteString(" [")
+	buf.WriteString(e.start.Format(_CLF_TIME))
+	buf.WriteString(`] "`)
+	buf.WriteString(req.ReqMethod())
+	buf.WriteByte(' ')
+	buf.WriteString(req.URL().RequestURI())
+	buf.WriteByte(' ')
+	buf.WriteString(req.HTTPRequest().Proto)
+	buf.WriteString(`" `)
+	buf.WriteString(strconv.Itoa(e.status))
+	buf.WriteByte(' ')
+	if e.bytesOut == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(strconv.FormatInt(e.bytesOut, 10))
+	}
+
+	if l.Format == ACCESSLOG_COMBINED {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(clfField(req.GetHeader(zerver.HEADER_REFER))))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(clfField(req.GetHeader(zerver.HEADER_USERAGENT))))
+	}
+	buf.WriteByte('\n')
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+func (l *AccessLog) writeJSON(e *accessEntry) {
+	req := e.req
+	m := make(map[string]interface{}, len(l.Fields))
+	for _, f := range l.Fields {
+		switch f {
+		case "time":
+			m[f] = e.start.Format(time.RFC3339Nano)
+		case "remote":
+			m[f] = req.ClientIP()
+		case "host":
+			m[f] = req.URL().Host
+		case "method":
+			m[f] = req.ReqMethod()
+		case "url":
+			m[f] = req.URL().RequestURI()
+		case "path":
+			m[f] = req.URL().Path
+		case "query":
+			m[f] = req.URL().RawQuery
+		case "proto":
+			m[f] = req.HTTPRequest().Proto
+		case "pattern":
+			m[f] = req.Pattern()
+		case "status":
+			m[f] = e.status
+		case "bytesIn":
+			m[f] = e.bytesIn
+		case "bytesOut":
+			m[f] = e.bytesOut
+		case "latency":
+			m[f] = millis(e.latency)
+		case "ttfb":
+			m[f] = millis(e.ttfb)
+		case "requestId":
+			m[f] = requestID(req)
+		case "principal":
+			m[f] = Principal(req)
+		case "userAgent":
+			m[f] = req.GetHeader(zerver.HEADER_USERAGENT)
+		case "referer":
+			m[f] = req.GetHeader(zerver.HEADER_REFER)
+		}
+	}
+
+	json.NewEncoder(&l.buf).Encode(m) // Encode append '\n'
+}
+
+func (f *RotatingFile) open() error {
+	if f.MaxSize <= 0 {
+		f.MaxSize = 100 << 20
+	}
+	if f.MaxBackups == 0 {
+		f.MaxBackups = 7
+	}
+
+	fd, err := os.OpenFile(f.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	f.fd, f.size = fd, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.fd.Close(); err != nil {
+		return err
+	}
+	f.fd = nil
+
+	base := f.Filename + "." + time.Now().Format(_ROTATE_LAYOUT)
+	name := base
+	for seq := 1; ; seq++ { // never overwrite backups rotated in same millisecond
+		if _, err := os.Lstat(name); err != nil {
+			break
+		}
+		name = base + "-" + strconv.Itoa(seq)
+	}
+	if err := os.Rename(f.Filename, name); err != nil {
+		return err
+	}
+	if f.MaxBackups > 0 {
+		backups := f.backups()
+		for i := 0; i < len(backups)-f.MaxBackups; i++ {
+			os.Remove(backups[i].name)
+		}
+	}
+	return f.open()
+}
+
+// backups return rotated files from the oldest, files not named by rotate
+// are ignored
+func (f *RotatingFile) backups() []rotatedFile {
+	dir, prefix := filepath.Dir(f.Filename), filepath.Base(f.Filename)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var backups []rotatedFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := name[len(prefix):]
+		if len(suffix) < len(_ROTATE_LAYOUT) {
+			continue
+		}
+		t, err := time.Parse(_ROTATE_LAYOUT, suffix[:len(_ROTATE_LAYOUT)])
+		if err != nil {
+			continue
+		}
+
+		var seq int
+		if s := suffix[len(_ROTATE_LAYOUT):]; s != "" {
+			if s[0] != '-' {
+				continue
+			}
+			if seq, err = strconv.Atoi(s[1:]); err != nil || seq <= 0 || strconv.Itoa(seq) != s[1:] {
+				continue
+			}
+		}
+		backups = append(backups, rotatedFile{name: filepath.Join(dir, name), time: t, seq: seq})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].time.Equal(backups[j].time) {
+			return backups[i].time.Before(backups[j].time)
+		}
+		return backups[i].seq < backups[j].seq
+	})
+	return backups
+}
+
+func (f *RotatingFile) Write(data []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.fd == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(data)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.fd.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.fd == nil {
+		return nil
+	}
+	err := f.fd.Close()
+	f.fd = nil
+	return err
+}
@@ -0,0 +1,338 @@
+package filter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+	"github.com/cosiner/zerver/utils/handle"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// ATTR_PRINCIPAL is the request attribute of authenticated principal
+	ATTR_PRINCIPAL = "Principal"
+
+	_HEADER_APIKEY = "X-API-Key"
+
+	ErrAuthFailed = errors.Err("authentication failed")
+)
+
+type (
+	// PasswordStore verify username and password
+	PasswordStore interface {
+		zerver.Component
+		VerifyPassword(user, password string) (bool, error)
+	}
+
+	// KeyStore return principal of api key, empty if key is invalid
+	KeyStore interface {
+		zerver.Component
+		LookupKey(key string) (string, error)
+	}
+
+	// BasicAuth authenticate request by HTTP Basic, the principal is username
+	BasicAuth struct {
+		Store PasswordStore
+		Realm string // default "Restricted"
+
+		authScheme
+	}
+
+	// APIKeyAuth authenticate request by api key in header or query parameter
+	APIKeyAuth struct {
+		Store  KeyStore
+		Header string // default "X-API-Key"
+		Param  string // query parameter, disabled if empty
+		Realm  string // default "Restricted"
+
+		authScheme
+	}
+
+	// authScheme is the challenge and logger shared by auth filters
+	authScheme struct {
+		challenge string
+		log       *log.Logger
+	}
+
+	// HtpasswdStore is a PasswordStore loaded from htpasswd style file, only
+	// bcrypt hashes are supported, call Reload after file is changed
+	HtpasswdStore struct {
+		File string
+
+		users map[string][]byte
+		dummy []byte // compared for unknown user, keep timing same
+		mu    sync.RWMutex
+	}
+
+	// MemKeyStore is a KeyStore of static keys, Keys is key:principal
+	MemKeyStore struct {
+		Keys map[string]string
+
+		hashes     [][]byte
+		principals []string
+	}
+
+	// RedisAuthStore is both PasswordStore and KeyStore depends on component.Redis.
+	// Password bcrypt hash is stored at Prefix+"user:"+username, api key
+	// principal is stored at Prefix+"key:"+hex(sha256(key)), so keys are
+	// never stored in plain. The redis component must implements RedisGetter,
+	// such as component.Redis with RedisOption.Do.
+	RedisAuthStore struct {
+		Prefix string // default "Auth:"
+
+		store RedisGetter
+		dummy []byte
+	}
+
+	// RedisGetter is the command RedisAuthStore required, empty string and
+	// nil error is returned if key is absent
+	RedisGetter interface {
+		GetString(key string) (string, error)
+	}
+)
+
+// Principal return authenticated principal of request
+func Principal(req zerver.Request) string {
+	p, _ := req.Attr(ATTR_PRINCIPAL).(string)
+	return p
+}
+
+func hashKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func dummyHash() ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+}
+
+func compareHash(hash []byte, password string) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func (h *HtpasswdStore) Init(zerver.Env) error {
+	dummy, err := dummyHash()
+	if err != nil {
+		return err
+	}
+	h.dummy = dummy
+	return h.Reload()
+}
+
+func (h *HtpasswdStore) Destroy() {}
+
+// Reload read users from file, each line is "username:hash", empty lines and
+// lines start with '#' are ignored
+func (h *HtpasswdStore) Reload() error {
+	fd, err := os.Open(h.File)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	users := make(map[string][]byte)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		hash := line[i+1:]
+		if !strings.HasPrefix(hash, "$2") { // bcrypt only
+			continue
+		}
+		users[line[:i]] = []byte(hash)
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *HtpasswdStore) VerifyPassword(user, password string) (bool, error) {
+	h.mu.RLock()
+	hash, has := h.users[user]
+	h.mu.RUnlock()
+
+	if !has {
+		compareHash(h.dummy, password)
+		return false, nil
+	}
+	return compareHash(hash, password), nil
+}
+
+func (m *MemKeyStore) Init(zerver.Env) error {
+	m.hashes = make([][]byte, 0, len(m.Keys))
+	m.principals = make([]string, 0, len(m.Keys))
+	for key, principal := range m.Keys {
+		m.hashes = append(m.hashes, hashKey(key))
+		m.principals = append(m.principals, principal)
+	}
+	return nil
+}
+
+func (m *MemKeyStore) Destroy() {}
+
+// LookupKey compare key with all keys in constant time
+func (m *MemKeyStore) LookupKey(key string) (string, error) {
+	hash := hashKey(key)
+	var principal string
+	for i, h := range m.hashes {
+		if subtle.ConstantTimeCompare(h, hash) == 1 {
+			principal = m.principals[i]
+		}
+	}
+	return principal, nil
+}
+
+var _ RedisGetter = (*component.Redis)(nil)
+
+func (r *RedisAuthStore) Init(env zerver.Env) error {
+	rd, err := env.Component(component.REDIS)
+	if err != nil {
+		return err
+	}
+
+	store, is := rd.(RedisGetter)
+	if !is {
+		return errors.Err("redis component doesn't support GetString")
+	}
+	r.store = store
+	defval.String(&r.Prefix, "Auth:")
+
+	r.dummy, err = dummyHash()
+	return err
+}
+
+func (r *RedisAuthStore) Destroy() {
+	r.store = nil
+}
+
+func (r *RedisAuthStore) VerifyPassword(user, password string) (bool, error) {
+	hash, err := r.store.GetString(r.Prefix + "user:" + user)
+	if err != nil {
+		return false, err
+	}
+	if hash == "" {
+		compareHash(r.dummy, password)
+		return false, nil
+	}
+	return compareHash([]byte(hash), password), nil
+}
+
+// LookupKey lookup principal by key hash, the key itself is never compared
+func (r *RedisAuthStore) LookupKey(key string) (string, error) {
+	return r.store.GetString(r.Prefix + "key:" + hex.EncodeToString(hashKey(key)))
+}
+
+// authenticated store principal to request, or send 401 with challenge
+func (s *authScheme) authenticated(req zerver.Request, resp zerver.Response, chain zerver.FilterChain,
+	principal string, err error) {
+
+	logger := req.Log().For(s.log)
+	if err != nil {
+		logger.Error(log.M{"msg": "auth store failed", "err": err.Error()})
+		handle.SendProblem(req, resp, err)
+		return
+	}
+	if principal == "" {
+		if logger.IsDebugEnable() {
+			logger.Debug(log.M{"msg": "authentication failed", "ip": req.ClientIP()})
+		}
+		resp.Headers().Set(_HEADER_WWWAUTHENTICATE, s.challenge)
+		handle.SendProblem(req, resp, handle.NewProblem(http.StatusUnauthorized, ErrAuthFailed.Error()))
+		return
+	}
+
+	req.SetAttr(ATTR_PRINCIPAL, principal)
+	chain(req, resp)
+}
+
+func (b *BasicAuth) Init(env zerver.Env) error {
+	if b.Store == nil {
+		return errors.Err("basic auth store is not set")
+	}
+	if err := b.Store.Init(env); err != nil {
+		return err
+	}
+	defval.String(&b.Realm, "Restricted")
+	b.challenge = `Basic realm="` + b.Realm + `", charset="UTF-8"`
+	b.log = log.Derive("Filter", "BasicAuth")
+	return nil
+}
+
+func (b *BasicAuth) Destroy() {
+	b.Store.Destroy()
+}
+
+func (b *BasicAuth) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	var (
+		principal string
+		err       error
+	)
+	if auth, basic := req.Authorization(); basic {
+		if i := strings.IndexByte(auth, ':'); i > 0 {
+			user := auth[:i]
+			var ok bool
+			if ok, err = b.Store.VerifyPassword(user, auth[i+1:]); ok {
+				principal = user
+			}
+		}
+	}
+
+	b.authenticated(req, resp, chain, principal, err)
+}
+
+func (a *APIKeyAuth) Init(env zerver.Env) error {
+	if a.Store == nil {
+		return errors.Err("api key store is not set")
+	}
+	if err := a.Store.Init(env); err != nil {
+		return err
+	}
+	defval.String(&a.Header, _HEADER_APIKEY)
+	defval.String(&a.Realm, "Restricted")
+	a.challenge = `ApiKey realm="` + a.Realm + `", header="` + a.Header + `"`
+	a.log = log.Derive("Filter", "APIKeyAuth")
+	return nil
+}
+
+func (a *APIKeyAuth) Destroy() {
+	a.Store.Destroy()
+}
+
+func (a *APIKeyAuth) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	key := req.GetHeader(a.Header)
+	if key == "" && a.Param != "" {
+		key = req.Vars().QueryVar(a.Param)
+	}
+
+	var (
+		principal string
+		err       error
+	)
+	if key != "" {
+		principal, err = a.Store.LookupKey(key)
+	}
+
+	a.authenticated(req, resp, chain, principal, err)
+}
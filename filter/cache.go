@@ -0,0 +1,413 @@
+package filter
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+)
+
+const (
+	_HEADER_AGE    = "Age"
+	_HEADER_XCACHE = "X-Cache"
+
+	_CACHE_HIT   = "HIT"
+	_CACHE_MISS  = "MISS"
+	_CACHE_STALE = "STALE"
+)
+
+// cacheableStatus is the status can be cached by default(RFC 7231 6.1)
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+}
+
+type (
+	// Cache store GET responses(status, headers set by handler, body) and serve
+	// them until expired. Key is path, selected query params, and values of
+	// request headers listed in response Vary.
+	//
+	// Freshness is from handler's Cache-Control s-maxage or max-age, then TTL.
+	// Responses with no-store, no-cache, private or Set-Cookie are not stored,
+	// and responses of requests with Authorization need public or s-maxage.
+	// Request Cache-Control no-cache skip lookup, no-store skip cache.
+	//
+	// In stale-while-revalidate window, stale response is served and the
+	// request is replayed in background to refresh it, the replayed request has
+	// no body and goes through all filters again.
+	//
+	// Keys are path, query and host, purge by component.PurgeCache or
+	// Cache.Purge with path prefix, it's applied to all hosts.
+	Cache struct {
+		// default the registered component.CACHE, or a MemCacheStore
+		Store component.CacheStore
+		// query params in key, empty means all params
+		Params []string
+		// freshness if handler doesn't set max-age, 0 means only responses with
+		// max-age/s-maxage are stored
+		TTL time.Duration
+		// stale window if handler doesn't set stale-while-revalidate
+		StaleWhileRevalidate time.Duration
+		MaxBodySize          int64 // default 1M
+
+		owned        bool
+		revalidating map[string]bool
+		lock         sync.Mutex
+		log          *log.Logger
+	}
+
+	cacheRevalidateKey struct{}
+
+	// discardWriter is the response writer of background revalidation
+	discardWriter struct {
+		header http.Header
+	}
+
+	cacheControl map[string]string
+)
+
+func (w *discardWriter) Header() http.Header            { return w.header }
+func (w *discardWriter) Write(data []byte) (int, error) { return len(data), nil }
+func (w *discardWriter) WriteHeader(int)                {}
+
+func parseCacheControl(value string) cacheControl {
+	if value == "" {
+		return nil
+	}
+
+	cc := make(cacheControl)
+	for _, d := range strings.Split(value, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		var v string
+		if i := strings.IndexByte(d, '='); i > 0 {
+			d, v = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+		}
+		cc[strings.ToLower(strings.TrimSpace(d))] = v
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, has := cc[directive]
+	return has
+}
+
+// seconds return the duration of directive, -1 if it's absent or invalid
+func (cc cacheControl) seconds(directive string) time.Duration {
+	v, has := cc[directive]
+	if !has {
+		return -1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return time.Duration(n) * time.Second
+}
+
+func (c *Cache) Init(env zerver.Env) error {
+	if c.Store == nil {
+		if comp, err := env.Component(component.CACHE); err == nil {
+			c.Store = comp.(component.CacheStore)
+		} else {
+			c.Store = new(component.MemCacheStore)
+			c.owned = true
+		}
+	} else {
+		c.owned = true
+	}
+	if c.owned {
+		if err := c.Store.Init(env); err != nil {
+			return err
+		}
+	}
+
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	c.revalidating = make(map[string]bool)
+	c.log = log.Derive("Filter", "Cache")
+	return nil
+}
+
+func (c *Cache) Destroy() {
+	if c.owned {
+		c.Store.Destroy()
+	}
+}
+
+// Purge remove cached responses whose path is prefix or under it
+func (c *Cache) Purge(prefix string) (int, error) {
+	return c.Store.Purge(prefix)
+}
+
+func (c *Cache) key(req zerver.Request) string {
+	u := req.URL()
+	query := u.Query()
+	if len(c.Params) != 0 {
+		selected := make(url.Values, len(c.Params))
+		for _, p := range c.Params {
+			if v, has := query[p]; has {
+				selected[p] = v
+			}
+		}
+		query = selected
+	}
+	// Encode sort by key, host is like a vary header, so path is still prefix
+	return u.Path + "?" + query.Encode() + "\nHost:" + strings.ToLower(u.Host)
+}
+
+func varyKey(key string, vary []string, req zerver.Request) string {
+	for _, name := range vary {
+		key += "\n" + name + ":" + req.GetHeader(name)
+	}
+	return key
+}
+
+// parseVary return canonical header names sorted, false if it's "*"
+func parseVary(values []string) ([]string, bool) {
+	var vary []string
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, false
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// lookup return the cached response and key of it, if the response is
+// absent, the key is empty
+func (c *Cache) lookup(req zerver.Request, key string) (*component.CachedResponse, string, error) {
+	r, err := c.Store.Get(key)
+	if r == nil || err != nil {
+		return nil, "", err
+	}
+	if r.Status == 0 && len(r.Vary) != 0 { // index of variants
+		key = varyKey(key, r.Vary, req)
+		if r, err = c.Store.Get(key); r == nil || err != nil {
+			return nil, "", err
+		}
+	}
+	return r, key, nil
+}
+
+func (c *Cache) serve(req zerver.Request, resp zerver.Response, r *component.CachedResponse, state string) {
+	headers := resp.Headers()
+	for k, v := range r.Header { // stored response is shared, never modify it
+		headers[k] = append([]string(nil), v...)
+	}
+	headers.Set(_HEADER_AGE, strconv.Itoa(int(time.Since(r.Stored)/time.Second)))
+	headers.Set(_HEADER_XCACHE, state)
+	resp.StatusCode(r.Status)
+	if req.ReqMethod() != zerver.METHOD_HEAD {
+		resp.Write(r.Body)
+	}
+}
+
+func (c *Cache) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	method := req.ReqMethod()
+	if method != zerver.METHOD_GET && method != zerver.METHOD_HEAD {
+		chain(req, resp)
+		return
+	}
+	reqCC := parseCacheControl(req.GetHeader(zerver.HEADER_CACHECONTROL))
+	if reqCC.has("no-store") {
+		chain(req, resp)
+		return
+	}
+
+	logger := req.Log().For(c.log)
+	key := c.key(req)
+	revalidating := req.Context().Value(cacheRevalidateKey{}) != nil
+	if !revalidating && !reqCC.has("no-cache") {
+		r, rkey, err := c.lookup(req, key)
+		if err != nil { // process without cache if store failed
+			logger.Warn(log.M{"msg": "cache store failed", "err": err.Error()})
+			chain(req, resp)
+			return
+		}
+		if r != nil {
+			now := time.Now()
+			if now.Before(r.Expires) {
+				c.serve(req, resp, r, _CACHE_HIT)
+				return
+			}
+			if now.Before(r.StaleUntil) {
+				c.serve(req, resp, r, _CACHE_STALE)
+				c.revalidate(req, rkey)
+				return
+			}
+		}
+	}
+
+	headers := resp.Headers()
+	before := make(http.Header, len(headers))
+	for k, v := range headers {
+		before[k] = v
+	}
+	headers.Set(_HEADER_XCACHE, _CACHE_MISS)
+
+	var w *recordWriter
+	if method == zerver.METHOD_GET { // HEAD has no body to store
+		resp.Wrap(func(rw http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
+			w = &recordWriter{ResponseWriter: rw, max: c.MaxBodySize, needClose: needClose}
+			return w, true
+		})
+	}
+
+	chain(req, resp)
+
+	if w == nil || w.overflow || w.hijacked {
+		return
+	}
+	r, vary := c.cachedResponse(req, resp, before, w)
+	if r == nil {
+		return
+	}
+	ttl := r.StaleUntil.Sub(r.Stored)
+	if len(vary) != 0 {
+		r.Vary = vary
+		if err := c.Store.Set(key, &component.CachedResponse{Vary: vary, Stored: r.Stored}, ttl); err != nil {
+			logger.Warn(log.M{"msg": "save cached response failed", "err": err.Error()})
+			return
+		}
+		key = varyKey(key, vary, req)
+	}
+	if err := c.Store.Set(key, r, ttl); err != nil {
+		logger.Warn(log.M{"msg": "save cached response failed", "err": err.Error()})
+	}
+}
+
+// cachedResponse build the response to store, nil if it's not cacheable
+func (c *Cache) cachedResponse(req zerver.Request, resp zerver.Response, before http.Header, w *recordWriter) (*component.CachedResponse, []string) {
+	status := resp.StatusCode(0)
+	if !cacheableStatus[status] {
+		return nil, nil
+	}
+	headers := resp.Headers()
+	if len(headers[zerver.HEADER_SETCOOKIE]) != 0 {
+		return nil, nil
+	}
+	cc := parseCacheControl(headers.Get(zerver.HEADER_CACHECONTROL))
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		return nil, nil
+	}
+	if req.GetHeader(zerver.HEADER_AUTHRIZATION) != "" && !cc.has("public") && !cc.has("s-maxage") {
+		return nil, nil
+	}
+	vary, ok := parseVary(headers[zerver.HEADER_VARY])
+	if !ok {
+		return nil, nil
+	}
+
+	fresh := cc.seconds("s-maxage")
+	if fresh < 0 {
+		fresh = cc.seconds("max-age")
+	}
+	if fresh < 0 {
+		fresh = c.TTL
+	}
+	if fresh <= 0 {
+		return nil, nil
+	}
+	stale := cc.seconds("stale-while-revalidate")
+	if stale < 0 {
+		stale = c.StaleWhileRevalidate
+	}
+
+	// only store headers set by inner filters and handler, such as correlation
+	// id set by outer filters shouldn't be replayed
+	header := make(http.Header)
+	for k, v := range headers {
+		if k == _HEADER_XCACHE || k == _HEADER_AGE || headerEqual(before[k], v) {
+			continue
+		}
+		header[k] = v
+	}
+
+	now := time.Now()
+	return &component.CachedResponse{
+		Status:     status,
+		Header:     header,
+		Body:       append([]byte(nil), w.buf.Bytes()...),
+		Stored:     now,
+		Expires:    now.Add(fresh),
+		StaleUntil: now.Add(fresh + stale),
+	}, vary
+}
+
+func headerEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidate replay the request in background to refresh cached response,
+// at most one replay for a key at the same time
+func (c *Cache) revalidate(req zerver.Request, key string) {
+	c.lock.Lock()
+	if c.revalidating[key] {
+		c.lock.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.lock.Unlock()
+
+	// copy request, original one is reused after filter return
+	r := req.HTTPRequest()
+	requ := r.WithContext(context.WithValue(context.Background(), cacheRevalidateKey{}, true))
+	requ.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		requ.Header[k] = v
+	}
+	u := *requ.URL
+	requ.URL = &u
+	requ.Method = zerver.METHOD_GET // HEAD response is not stored
+	requ.Header.Del(_HEADER_IFNONEMATCH)
+	requ.Header.Del(_HEADER_IFMODIFIEDSINCE)
+	requ.Body = http.NoBody
+	requ.ContentLength = 0
+
+	server := req.Server()
+	pattern := req.Pattern()
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				server.HandlePanic(zerver.NewPanic(zerver.PANIC_HTTP, pattern, v))
+			}
+			c.lock.Lock()
+			delete(c.revalidating, key)
+			c.lock.Unlock()
+		}()
+
+		server.ServeHTTP(&discardWriter{header: make(http.Header)}, requ)
+	}()
+}
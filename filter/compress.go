@@ -8,103 +8,260 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
 	"github.com/cosiner/zerver"
 )
 
-type gzipWriter struct {
-	gw *gzip.Writer
-	http.ResponseWriter
-	needClose bool
+const (
+	ErrCompressLevel = errors.Err("compression level must be between -2(huffman only) and 9(best compression)")
+)
+
+// DefCompressTypes is the default content types to compress, type end with
+// '*' is matched by prefix
+var DefCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/problem+json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
 }
 
-func (w gzipWriter) Write(data []byte) (int, error) {
-	return w.gw.Write(data)
+// Compression compress response with gzip or deflate selected by q-values
+// of Accept-Encoding. The first MinSize bytes are buffered before deciding,
+// responses smaller than it, with content type not in Types, or already has
+// Content-Encoding are not compressed.
+type Compression struct {
+	MinSize int      // default 1024
+	Level   int      // compression level, default flate.DefaultCompression
+	Types   []string // content types allowed, default DefCompressTypes
+
+	gzipPool  sync.Pool
+	flatePool sync.Pool
 }
 
-func (w gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hijacker, is := w.ResponseWriter.(http.Hijacker)
-	if !is {
-		return nil, nil, zerver.ErrHijack
+var defCompression = func() *Compression {
+	c := &Compression{}
+	c.Init(nil)
+	return c
+}()
+
+// Compress is the Compression filter with default options
+func Compress(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	defCompression.Filter(req, resp, chain)
+}
+
+func (c *Compression) Init(zerver.Env) error {
+	defval.Int(&c.MinSize, 1024)
+	if c.Level == 0 {
+		c.Level = flate.DefaultCompression
+	} else if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return ErrCompressLevel
+	}
+	if len(c.Types) == 0 {
+		c.Types = DefCompressTypes
 	}
 
-	w.gw.Close()
+	level := c.Level // validated, writers can't fail
+	c.gzipPool.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	c.flatePool.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	return nil
+}
 
-	return hijacker.Hijack()
+func (c *Compression) Destroy() {}
+
+func (c *Compression) allowed(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for _, typ := range c.Types {
+		if strings.HasSuffix(typ, "*") {
+			if strings.HasPrefix(contentType, typ[:len(typ)-1]) {
+				return true
+			}
+		} else if typ == contentType {
+			return true
+		}
+	}
+	return false
 }
 
-func (w gzipWriter) Close() error {
-	err := w.gw.Close()
-	if w.needClose {
-		_ = w.ResponseWriter.(io.Closer).Close()
+func (c *Compression) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	zerver.AddVary(resp.Headers(), zerver.HEADER_ACCEPTENCODING)
+
+	encoding := zerver.AcceptEncoding(req.GetHeader(zerver.HEADER_ACCEPTENCODING),
+		zerver.ENCODING_GZIP, zerver.ENCODING_DEFLATE)
+	if encoding == "" || req.ReqMethod() == zerver.METHOD_HEAD {
+		chain(req, resp)
+		return
 	}
 
-	return err
+	resp.Wrap(func(w http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
+		return &compressWriter{
+			ResponseWriter: w,
+			c:              c,
+			encoding:       encoding,
+			status:         http.StatusOK,
+			needClose:      needClose,
+		}, true
+	})
+	chain(req, resp)
 }
 
-type flateWriter struct {
-	fw *flate.Writer
+// compressWriter buffer the first MinSize bytes and delay the header until
+// decided whether compress
+type compressWriter struct {
 	http.ResponseWriter
+	c        *Compression
+	encoding string
+
+	status    int
+	buf       []byte
+	decided   bool
+	cw        io.WriteCloser
 	needClose bool
 }
 
-func (w flateWriter) Write(data []byte) (int, error) {
-	return w.fw.Write(data)
+type flusher interface {
+	Flush() error
 }
 
-func (w flateWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hijacker, is := w.ResponseWriter.(http.Hijacker)
-	if !is {
-		return nil, nil, zerver.ErrHijack
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusNotModified || status == http.StatusPartialContent {
+		w.decide(false)
 	}
+}
 
-	w.fw.Close()
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if len(w.buf)+len(data) < w.c.MinSize {
+			w.buf = append(w.buf, data...)
+			return len(data), nil
+		}
 
-	return hijacker.Hijack()
+		w.decide(true)
+		buf := w.buf
+		w.buf = nil
+		if _, err := w.write(buf); err != nil {
+			return 0, err
+		}
+	}
+
+	return w.write(data)
 }
 
-func (w flateWriter) Close() error {
-	err := w.fw.Close()
-	if w.needClose {
-		_ = w.ResponseWriter.(io.Closer).Close()
+func (w *compressWriter) write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
 	}
+	if w.cw != nil {
+		return w.cw.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
 
-	return err
+// decide whether compress and write header, enough reports whether body is
+// not smaller than MinSize
+func (w *compressWriter) decide(enough bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	headers := w.Header()
+	if headers.Get(zerver.HEADER_CONTENTTYPE) == "" && len(w.buf) != 0 {
+		headers.Set(zerver.HEADER_CONTENTTYPE, http.DetectContentType(w.buf))
+	}
+	if enough && headers.Get(zerver.HEADER_CONTENTENCODING) == "" &&
+		w.c.allowed(headers.Get(zerver.HEADER_CONTENTTYPE)) {
+
+		headers.Set(zerver.HEADER_CONTENTENCODING, w.encoding)
+		headers.Del(zerver.HEADER_CONTENTLENGTH)
+		if w.encoding == zerver.ENCODING_GZIP {
+			gw := w.c.gzipPool.Get().(*gzip.Writer)
+			gw.Reset(w.ResponseWriter)
+			w.cw = gw
+		} else {
+			fw := w.c.flatePool.Get().(*flate.Writer)
+			fw.Reset(w.ResponseWriter)
+			w.cw = fw
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
 }
 
-func gzipWrapper(w http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
-	return gzipWriter{
-		gw:             gzip.NewWriter(w),
-		ResponseWriter: w,
-		needClose:      needClose,
-	}, true
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.c.MinSize)
+		buf := w.buf
+		w.buf = nil
+		w.write(buf)
+	}
+	if f, is := w.cw.(flusher); is {
+		f.Flush()
+	}
+	if f, is := w.ResponseWriter.(http.Flusher); is {
+		f.Flush()
+	}
 }
 
-func flateWrapper(w http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
-	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, is := w.ResponseWriter.(http.Hijacker)
+	if !is {
+		return nil, nil, zerver.ErrHijack
+	}
 
-	return flateWriter{
-		fw:             fw,
-		ResponseWriter: w,
-		needClose:      needClose,
-	}, true
+	w.decided = true // nothing should be written after hijacked
+	w.buf = nil
+	w.release()
+	return hijacker.Hijack()
 }
 
-func Compress(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
-	encoding := req.GetHeader(zerver.HEADER_ACCEPTENCODING)
-
-	respHeaders := resp.Headers()
-	if strings.Contains(encoding, zerver.ENCODING_GZIP) {
-		respHeaders.Set(zerver.HEADER_CONTENTENCODING, zerver.ENCODING_GZIP)
-		resp.Wrap(gzipWrapper)
-	} else if strings.Contains(encoding, zerver.ENCODING_DEFLATE) {
-		respHeaders.Set(zerver.HEADER_CONTENTENCODING, zerver.ENCODING_DEFLATE)
-		resp.Wrap(flateWrapper)
-	} else {
-		chain(req, resp)
+func (w *compressWriter) release() {
+	if w.cw == nil {
 		return
 	}
 
-	chain(req, resp)
-	respHeaders.Del(zerver.HEADER_CONTENTLENGTH)
+	if gw, is := w.cw.(*gzip.Writer); is {
+		gw.Reset(nil)
+		w.c.gzipPool.Put(gw)
+	} else if fw, is := w.cw.(*flate.Writer); is {
+		fw.Reset(nil)
+		w.c.flatePool.Put(fw)
+	}
+	w.cw = nil
+}
+
+func (w *compressWriter) Close() error {
+	var err error
+	if !w.decided {
+		w.decide(false)
+		_, err = w.write(w.buf)
+		w.buf = nil
+	}
+	if w.cw != nil {
+		if e := w.cw.Close(); err == nil {
+			err = e
+		}
+		w.release()
+	}
+	if w.needClose {
+		_ = w.ResponseWriter.(io.Closer).Close()
+	}
+
+	return err
 }
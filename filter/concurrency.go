@@ -0,0 +1,209 @@
+package filter
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/monitor"
+)
+
+// ConcurrencyLimit cap in-flight requests, requests over the limit wait in a
+// bounded queue, if the queue is full or waiting timeout, they are shed with
+// 503 and Retry-After.
+//
+// Register it at "/" for global limit, and more instances at route group
+// prefixes for per group limits, each instance must have an unique Name, it's
+// used as the prefix of monitor gauges.
+//
+// In adaptive mode, the limit is decreased multiplicatively if average latency
+// exceeds TargetLatency, and increased by one if it's below and the limit is
+// reached, the limit is always between MinLimit and MaxLimit.
+type ConcurrencyLimit struct {
+	Name         string        // gauge name prefix for monitor, must be unique, default "concurrency"
+	Limit        int           // max in-flight requests, also the initial limit in adaptive mode, default 256
+	QueueSize    int           // max waiting requests, 0 means no waiting
+	QueueTimeout time.Duration // max waiting duration, default 100ms
+	RetryAfter   int           // seconds for Retry-After header, default 1
+
+	Adaptive      bool
+	MinLimit      int           // default 1
+	MaxLimit      int           // default 4 * Limit
+	TargetLatency time.Duration // default 100ms
+	SampleSize    int           // requests for each adjustment, default 100
+
+	lock     sync.Mutex
+	inflight int
+	limit    int
+	waiters  []chan struct{}
+
+	samples int
+	latency time.Duration
+
+	retryAfter string
+}
+
+// concurrencyNames is names of initialized instances, so their gauges don't
+// override each other
+var concurrencyNames = struct {
+	sync.Mutex
+	names map[string]*ConcurrencyLimit
+}{names: make(map[string]*ConcurrencyLimit)}
+
+func (c *ConcurrencyLimit) Init(zerver.Env) error {
+	defval.String(&c.Name, "concurrency")
+	concurrencyNames.Lock()
+	owner := concurrencyNames.names[c.Name]
+	if owner == nil {
+		concurrencyNames.names[c.Name] = c
+	}
+	concurrencyNames.Unlock()
+	if owner != nil && owner != c {
+		return errors.Err("concurrency limit name " + c.Name + " is already used, set an unique Name for each instance")
+	}
+
+	defval.Int(&c.Limit, 256)
+	if c.QueueTimeout <= 0 {
+		c.QueueTimeout = 100 * time.Millisecond
+	}
+	defval.Int(&c.RetryAfter, 1)
+	c.retryAfter = strconv.Itoa(c.RetryAfter)
+
+	if c.Adaptive {
+		defval.Int(&c.MinLimit, 1)
+		defval.Int(&c.MaxLimit, 4*c.Limit)
+		if c.TargetLatency <= 0 {
+			c.TargetLatency = 100 * time.Millisecond
+		}
+		defval.Int(&c.SampleSize, 100)
+	}
+	c.limit = c.Limit
+
+	monitor.RegisterGauge(c.Name+".inflight", c.gauge(func() int { return c.inflight }))
+	monitor.RegisterGauge(c.Name+".queued", c.gauge(func() int { return len(c.waiters) }))
+	monitor.RegisterGauge(c.Name+".limit", c.gauge(func() int { return c.limit }))
+	return nil
+}
+
+func (c *ConcurrencyLimit) Destroy() {
+	concurrencyNames.Lock()
+	defer concurrencyNames.Unlock()
+	if concurrencyNames.names[c.Name] != c {
+		return
+	}
+	delete(concurrencyNames.names, c.Name)
+
+	monitor.UnregisterGauge(c.Name + ".inflight")
+	monitor.UnregisterGauge(c.Name + ".queued")
+	monitor.UnregisterGauge(c.Name + ".limit")
+}
+
+func (c *ConcurrencyLimit) gauge(fn func() int) func() int64 {
+	return func() int64 {
+		c.lock.Lock()
+		n := fn()
+		c.lock.Unlock()
+		return int64(n)
+	}
+}
+
+// Inflight return current in-flight requests
+func (c *ConcurrencyLimit) Inflight() int {
+	c.lock.Lock()
+	n := c.inflight
+	c.lock.Unlock()
+	return n
+}
+
+func (c *ConcurrencyLimit) acquire() bool {
+	c.lock.Lock()
+	if c.inflight < c.limit {
+		c.inflight++
+		c.lock.Unlock()
+		return true
+	}
+	if len(c.waiters) >= c.QueueSize {
+		c.lock.Unlock()
+		return false
+	}
+
+	ch := make(chan struct{})
+	c.waiters = append(c.waiters, ch)
+	c.lock.Unlock()
+
+	timer := time.NewTimer(c.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, w := range c.waiters {
+		if w == ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return false
+		}
+	}
+	return true // slot was handed over just before removing
+}
+
+// release hand the slot over to the first waiter, or decrease in-flight count
+func (c *ConcurrencyLimit) release(latency time.Duration) {
+	c.lock.Lock()
+	if c.Adaptive {
+		c.adapt(latency)
+	}
+
+	if len(c.waiters) != 0 && c.inflight <= c.limit {
+		ch := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		close(ch)
+	} else {
+		c.inflight--
+	}
+	c.lock.Unlock()
+}
+
+// adapt must be called with lock held
+func (c *ConcurrencyLimit) adapt(latency time.Duration) {
+	c.samples++
+	c.latency += latency
+	if c.samples < c.SampleSize {
+		return
+	}
+
+	avg := c.latency / time.Duration(c.samples)
+	c.samples, c.latency = 0, 0
+	if avg > c.TargetLatency {
+		c.limit = c.limit * 9 / 10
+	} else if c.inflight >= c.limit {
+		c.limit++
+	}
+
+	if c.limit < c.MinLimit {
+		c.limit = c.MinLimit
+	} else if c.limit > c.MaxLimit {
+		c.limit = c.MaxLimit
+	}
+}
+
+func (c *ConcurrencyLimit) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	if !c.acquire() {
+		resp.Headers().Set(_HEADER_RETRYAFTER, c.retryAfter)
+		resp.StatusCode(http.StatusServiceUnavailable)
+		return
+	}
+
+	begin := time.Now()
+	defer func() {
+		c.release(time.Since(begin))
+	}()
+	chain(req, resp)
+}
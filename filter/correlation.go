@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/cosiner/gohper/utils/defval"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	_HEADER_CORRELATIONID = "X-Correlation-Id"
+	_CROCKFORD            = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// Correlation accept correlation id from request header, or generate one if
+// it's absent or invalid. The id is echoed in response header, stored to
+// request(req.CorrelationID()), added to entries of req.Log() and resp.Log(),
+// and carried into tasks started by req.StartTask.
+//
+// Loggers created by log.Derive don't know the request, entries logged by them
+// directly don't have the id, log through req.Log().For(logger) instead, as
+// builtin filters, components and handlers do.
+//
+// It's different from RequestId, which is a duplicate-submission guard use
+// header X-Request-Id.
+type Correlation struct {
+	HeaderName string            // default "X-Correlation-Id", same as handle.TraceIDHeader so problem details include it
+	Generate   func() string     // default NewUUID
+	Validate   func(string) bool // validate incoming id, default ValidCorrelationID
+	NoAccept   bool              // always generate new id, ignore incoming id
+}
+
+// NewUUID generate a random(version 4) UUID
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+// NewULID generate a ULID, it's sortable by generate time in milliseconds
+func NewULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+
+	// 128 bits to 26 characters, 5 bits each, the first character use 3 bits
+	var s [26]byte
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		s[i] = _CROCKFORD[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+// ValidCorrelationID accept ids at most 128 characters of letters, digits and
+// "-_.:", incoming ids are put into headers and logs, so they are restricted
+func ValidCorrelationID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Correlation) Init(zerver.Env) error {
+	defval.String(&c.HeaderName, _HEADER_CORRELATIONID)
+	if c.Generate == nil {
+		c.Generate = NewUUID
+	}
+	if c.Validate == nil {
+		c.Validate = ValidCorrelationID
+	}
+	return nil
+}
+
+func (c *Correlation) Destroy() {}
+
+func (c *Correlation) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	var id string
+	if !c.NoAccept {
+		if id = req.GetHeader(c.HeaderName); !c.Validate(id) {
+			id = ""
+		}
+	}
+	if id == "" {
+		id = c.Generate()
+	}
+
+	req.SetAttr(zerver.ATTR_CORRELATIONID, id)
+	req.Log().Set(zerver.LOG_CORRELATIONID, id)
+	resp.Headers().Set(c.HeaderName, id)
+	chain(req, resp)
+}
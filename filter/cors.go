@@ -2,11 +2,14 @@ package filter
 
 import (
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/cosiner/gohper/strings2"
 	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
 	"github.com/cosiner/zerver"
 )
 
@@ -25,15 +28,30 @@ const (
 	_CORS_MAXAGE           = "Access-Control-Max-Age"
 )
 
+// CORS handle cross-origin requests. Origins can be exact origin, "*" for all,
+// wildcard pattern such as "https://*.example.com", or regexp start with '^'.
+// If credentials are allowed, the request origin is reflected instead of "*",
+// allow credentials for all origins let any site read responses with user's
+// cookies, it's only kept for compatibility and a warning is logged, list
+// origins explicitly instead.
+//
+// Preflight requests are answered by filter, so routes don't need OPTIONS
+// handler. Groups is policies for route groups keyed by path prefix, the
+// longest prefix matched on segment boundary is used, "/api" match "/api"
+// and "/api/users" but not "/apis", and it's initialized by parent.
 type CORS struct {
 	Origins          []string
 	Methods          []string
 	Headers          []string
-	ExposeHeaders    []string `json:"expose_headers"`   // these headers can be accessed by javascript
-	PreflightMaxage  int      `json:"preflight_maxage"` // max efficient seconds of browser preflight
-	AllowCredentials bool     `json:"allow_cred"`
+	ExposeHeaders    []string         `json:"expose_headers"`   // these headers can be accessed by javascript
+	PreflightMaxage  int              `json:"preflight_maxage"` // max efficient seconds of browser preflight
+	AllowCredentials bool             `json:"allow_cred"`
+	Groups           map[string]*CORS `json:"groups"`
 
 	allowAll         bool
+	origins          map[string]bool
+	patterns         []*regexp.Regexp
+	groups           []string // prefixes sorted by length desc
 	methods          string
 	headers          string
 	exposeHeaders    string
@@ -46,11 +64,40 @@ var (
 	defAllowMethods = []string{"GET", "POST", "PATCH", "PUT", "DELETE"}
 )
 
-func (c *CORS) Init(zerver.Env) error {
+func (c *CORS) Init(env zerver.Env) error {
 	if l := len(c.Origins); l == 0 || (l == 1 && c.Origins[0] == "*") {
+		if c.AllowCredentials {
+			log.Derive("Filter", "CORS").Warn(log.M{"msg": "credentials are allowed for all origins, list them in Origins"})
+		}
 		c.allowAll = true
 		c.Origins = nil
 	}
+	c.origins = make(map[string]bool)
+	for _, o := range c.Origins {
+		if strings.HasPrefix(o, "^") {
+			re, err := regexp.Compile(o)
+			if err != nil {
+				return err
+			}
+			c.patterns = append(c.patterns, re)
+		} else if strings.Contains(o, "*") {
+			pattern := strings.Replace(regexp.QuoteMeta(strings.ToLower(o)), `\*`, `[a-z0-9.-]+`, -1)
+			c.patterns = append(c.patterns, regexp.MustCompile("^"+pattern+"$"))
+		} else {
+			c.origins[strings.ToLower(o)] = true
+		}
+	}
+
+	c.groups = c.groups[:0]
+	for prefix, g := range c.Groups {
+		if err := g.Init(env); err != nil {
+			return err
+		}
+		c.groups = append(c.groups, prefix)
+	}
+	sort.Slice(c.groups, func(i, j int) bool {
+		return len(c.groups[i]) > len(c.groups[j])
+	})
 
 	defval.Nil(&c.Methods, defAllowMethods)
 	c.methods = strings.Join(c.Methods, ",")
@@ -62,7 +109,9 @@ func (c *CORS) Init(zerver.Env) error {
 	}
 
 	c.exposeHeaders = strings.Join(c.ExposeHeaders, ",")
-	defval.BoolStr(c.AllowCredentials, &c.allowCredentials)
+	if c.AllowCredentials {
+		c.allowCredentials = "true"
+	}
 
 	if c.PreflightMaxage != 0 {
 		c.preflightMaxage = strconv.Itoa(c.PreflightMaxage)
@@ -74,24 +123,61 @@ func (c *CORS) Init(zerver.Env) error {
 func (c *CORS) Destroy() {}
 
 func (c *CORS) allow(origin string) bool {
-	var has bool
+	if c.allowAll {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin return the value of Access-Control-Allow-Origin, empty if
+// origin is not allowed. Vary: Origin is added if the value depends on origin.
+func (c *CORS) allowOrigin(resp zerver.Response, origin string) string {
+	if c.allowAll && !c.AllowCredentials {
+		return "*"
+	}
 
-	for i := 0; i < len(c.Origins) && !has; i++ {
-		has = c.Origins[i] == origin
+	zerver.AddVary(resp.Headers(), _CORS_ORIGIN)
+	if c.allow(origin) {
+		return origin
 	}
+	return ""
+}
 
-	return has
+// hasPathPrefix report whether path is prefix or under it, prefix end with '/'
+// is matched as is
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
 }
 
-func (c *CORS) preflight(req zerver.Request, resp zerver.Response, method, headers string) {
-	origin := "*"
-	if !c.allowAll {
-		origin = req.GetHeader(_CORS_ORIGIN)
-		if !c.allow(origin) {
-			resp.StatusCode(http.StatusOK)
-			return
+// policy return the policy of request path
+func (c *CORS) policy(path string) *CORS {
+	for _, prefix := range c.groups {
+		if hasPathPrefix(path, prefix) {
+			return c.Groups[prefix].policy(path)
 		}
 	}
+	return c
+}
+
+func (c *CORS) preflight(req zerver.Request, resp zerver.Response, origin, method, headers string) {
+	// answer preflight even if route has no OPTIONS handler
+	resp.StatusCode(http.StatusOK)
+	if origin = c.allowOrigin(resp, origin); origin == "" {
+		return
+	}
 
 	respHeaders := resp.Headers()
 	respHeaders.Set(_CORS_ALLOWORIGIN, origin)
@@ -113,7 +199,9 @@ func (c *CORS) preflight(req zerver.Request, resp zerver.Response, method, heade
 		}
 	}
 
-	respHeaders.Set(_CORS_ALLOWCREDENTIALS, c.allowCredentials)
+	if c.allowCredentials != "" {
+		respHeaders.Set(_CORS_ALLOWCREDENTIALS, c.allowCredentials)
+	}
 	if c.exposeHeaders != "" {
 		respHeaders.Set(_CORS_EXPOSEHEADERS, c.exposeHeaders)
 	}
@@ -121,26 +209,22 @@ func (c *CORS) preflight(req zerver.Request, resp zerver.Response, method, heade
 	if c.preflightMaxage != "" {
 		respHeaders.Set(_CORS_MAXAGE, c.preflightMaxage)
 	}
-
-	resp.StatusCode(http.StatusOK)
 }
 
-func (c *CORS) filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+func (c *CORS) filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain, origin string) {
 	headers := resp.Headers()
-	origin := "*"
-	if !c.allowAll {
-		origin = req.GetHeader(_CORS_ORIGIN)
-		if !c.allow(origin) {
-			resp.StatusCode(http.StatusForbidden)
-			return
-		}
+	if origin = c.allowOrigin(resp, origin); origin == "" {
+		resp.StatusCode(http.StatusForbidden)
+		return
 	}
 	headers.Set(_CORS_ALLOWORIGIN, origin)
 
 	headers.Set(_CORS_ALLOWMETHODS, c.methods)
 	headers.Set(_CORS_ALLOWHEADERS, c.headers)
 
-	headers.Set(_CORS_ALLOWCREDENTIALS, c.allowCredentials)
+	if c.allowCredentials != "" {
+		headers.Set(_CORS_ALLOWCREDENTIALS, c.allowCredentials)
+	}
 	if c.exposeHeaders != "" {
 		headers.Set(_CORS_EXPOSEHEADERS, c.exposeHeaders)
 	}
@@ -152,12 +236,22 @@ func (c *CORS) filter(req zerver.Request, resp zerver.Response, chain zerver.Fil
 }
 
 func (c *CORS) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	p := c.policy(req.URL().Path)
+	origin := req.GetHeader(_CORS_ORIGIN)
+	if origin == "" { // not a cross-origin request
+		if !p.allowAll || p.AllowCredentials {
+			zerver.AddVary(resp.Headers(), _CORS_ORIGIN)
+		}
+		chain(req, resp)
+		return
+	}
+
 	reqMethod := req.GetHeader(_CORS_REQUESTMETHOD)
 	reqHeaders := req.GetHeader(_CORS_REQUESTHEADERS)
 
 	if req.ReqMethod() == zerver.METHOD_OPTIONS && (reqMethod != "" || reqHeaders != "") {
-		c.preflight(req, resp, reqMethod, reqHeaders)
+		p.preflight(req, resp, origin, reqMethod, reqHeaders)
 	} else {
-		c.filter(req, resp, chain)
+		p.filter(req, resp, chain, origin)
 	}
 }
@@ -0,0 +1,182 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cosiner/zerver"
+)
+
+const (
+	_HEADER_ETAG            = "ETag"
+	_HEADER_IFNONEMATCH     = "If-None-Match"
+	_HEADER_LASTMODIFIED    = "Last-Modified"
+	_HEADER_IFMODIFIEDSINCE = "If-Modified-Since"
+)
+
+// ETag buffer response of GET request and generate ETag for it if handler
+// doesn't set, then answer If-None-Match and If-Modified-Since with 304.
+// Streaming(flushed), hijacked and non-200 responses are skipped.
+type ETag struct {
+	Weak bool // generate weak ETag
+}
+
+func (e *ETag) Init(zerver.Env) error { return nil }
+
+func (e *ETag) Destroy() {}
+
+type etagWriter struct {
+	http.ResponseWriter
+	buffer      bytes.Buffer
+	status      int
+	passing     bool // write directly to underlay writer
+	shouldClose bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	if w.passing {
+		w.ResponseWriter.WriteHeader(status)
+	} else {
+		w.status = status
+	}
+}
+
+func (w *etagWriter) Write(data []byte) (int, error) {
+	if !w.passing && w.Header().Get(zerver.HEADER_CONTENTTYPE) == "text/event-stream" {
+		w.pass()
+	}
+	if w.passing {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buffer.Write(data)
+}
+
+// pass write buffered status and data, then switch to passing mode
+func (w *etagWriter) pass() error {
+	if w.passing {
+		return nil
+	}
+
+	w.passing = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	var err error
+	if w.buffer.Len() != 0 {
+		_, err = w.ResponseWriter.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+	return err
+}
+
+func (w *etagWriter) Flush() {
+	w.pass()
+	if flusher, is := w.ResponseWriter.(http.Flusher); is {
+		flusher.Flush()
+	}
+}
+
+func (w *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, is := w.ResponseWriter.(http.Hijacker)
+	if !is {
+		return nil, nil, zerver.ErrHijack
+	}
+
+	w.passing = true
+	return hijacker.Hijack()
+}
+
+func (w *etagWriter) Close() error {
+	if w.shouldClose {
+		return w.ResponseWriter.(io.Closer).Close()
+	}
+	return nil
+}
+
+func (e *ETag) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	if req.ReqMethod() != zerver.METHOD_GET {
+		chain(req, resp)
+		return
+	}
+
+	w := &etagWriter{}
+	resp.Wrap(func(rw http.ResponseWriter, shouldClose bool) (http.ResponseWriter, bool) {
+		w.ResponseWriter = rw
+		w.shouldClose = shouldClose
+		return w, true
+	})
+	chain(req, resp)
+
+	if w.passing || w.status == 0 { // streamed, hijacked or nothing written
+		w.passing = true
+		return
+	}
+	if w.status != http.StatusOK {
+		w.pass()
+		return
+	}
+
+	headers := w.Header()
+	etag := headers.Get(_HEADER_ETAG)
+	if etag == "" {
+		etag = e.generate(w.buffer.Bytes())
+		headers.Set(_HEADER_ETAG, etag)
+	}
+
+	if notModified(req, etag, headers.Get(_HEADER_LASTMODIFIED)) {
+		headers.Del(zerver.HEADER_CONTENTTYPE)
+		headers.Del(zerver.HEADER_CONTENTLENGTH)
+		w.status = http.StatusNotModified
+		w.buffer.Reset()
+	}
+	w.pass()
+}
+
+func (e *ETag) generate(data []byte) string {
+	sum := sha1.Sum(data)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+	if e.Weak {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// notModified check If-None-Match first, if it's absent, check If-Modified-Since
+func notModified(req zerver.Request, etag, lastModified string) bool {
+	if inm := req.GetHeader(_HEADER_IFNONEMATCH); inm != "" {
+		return etagMatch(inm, etag)
+	}
+
+	ims := req.GetHeader(_HEADER_IFMODIFIEDSINCE)
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagMatch use weak comparison for If-None-Match
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,441 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+	"github.com/cosiner/zerver/utils/handle"
+)
+
+const (
+	_HEADER_IDEMPOTENCYKEY = "Idempotency-Key"
+	_HEADER_REPLAYED       = "Idempotent-Replayed"
+
+	ErrIdempotencyInFlight = errors.Err("request with same idempotency key is being processed")
+	ErrIdempotencyMismatch = errors.Err("idempotency key is reused with different payload")
+	ErrIdempotencyRequired = errors.Err("idempotency key is required")
+	ErrIdempotencyEncoding = errors.Err("stored response encoding is not acceptable")
+	ErrBodyTooLarge        = errors.Err("request body is too large")
+)
+
+type (
+	// Idempotency implements Idempotency-Key: the first response of a key is
+	// stored with TTL, later requests with same key and same payload get the
+	// stored response, with different payload get 422, and 409 if the first
+	// one is still processing. 5xx responses are not stored, so they can be
+	// retried.
+	//
+	// Keys are scoped by client, default by authenticated principal or client ip.
+	//
+	// The response is stored as written to the filter, put it inside Compress
+	// so it's stored before encoding. If a stored response has Content-Encoding
+	// not accepted by later request, 406 is sent instead of replaying it.
+	Idempotency struct {
+		Store       IdempotencyStore // default MemIdempotencyStore
+		HeaderName  string           // default "Idempotency-Key"
+		TTL         time.Duration    // default 24 hours
+		Methods     []string         // default POST, PATCH
+		Required    bool             // reject requests without key with 400
+		MaxBodySize int64            // max request/response body size, default 1M
+		Scope       func(zerver.Request) string
+
+		methods map[string]bool
+		log     *log.Logger
+	}
+
+	// IdempotentRecord is the stored state of a key, Done is false while the
+	// first request is processing
+	IdempotentRecord struct {
+		Fingerprint string      `json:"fingerprint"`
+		Done        bool        `json:"done"`
+		Status      int         `json:"status,omitempty"`
+		Header      http.Header `json:"header,omitempty"`
+		Body        []byte      `json:"body,omitempty"`
+	}
+
+	IdempotencyStore interface {
+		zerver.Component
+		// Begin reserve the key with fingerprint if it's absent and return nil,
+		// otherwise return the existing record
+		Begin(key, fingerprint string, ttl time.Duration) (*IdempotentRecord, error)
+		// Complete store the response of key
+		Complete(key string, record *IdempotentRecord, ttl time.Duration) error
+		// Cancel remove the reservation
+		Cancel(key string) error
+	}
+
+	// MemIdempotencyStore store records in memory
+	MemIdempotencyStore struct {
+		CleanInterval time.Duration // default 1 minute
+
+		records map[string]memRecord
+		lock    sync.Mutex
+		stop    chan struct{}
+	}
+
+	memRecord struct {
+		record *IdempotentRecord
+		expire time.Time
+	}
+
+	// RedisIdempotencyStore store records in component.Redis as json, the redis
+	// component must implements RedisIdempotencyCommands, such as
+	// component.Redis with RedisOption.Do
+	RedisIdempotencyStore struct {
+		Prefix string // default "Idempotency:"
+		store  RedisIdempotencyCommands
+	}
+
+	// RedisIdempotencyCommands is the commands RedisIdempotencyStore required,
+	// nil and nil error is returned by GetBytes if key is absent
+	RedisIdempotencyCommands interface {
+		SetNX(key string, value []byte, seconds int) (bool, error)
+		GetBytes(key string) ([]byte, error)
+		SetWithExpire(key string, value []byte, seconds int) error
+		Del(keys ...string) error
+	}
+
+	// recordWriter tee response body to buffer
+	recordWriter struct {
+		http.ResponseWriter
+		buf       bytes.Buffer
+		max       int64
+		overflow  bool
+		hijacked  bool
+		needClose bool
+	}
+)
+
+func (m *MemIdempotencyStore) Init(zerver.Env) error {
+	if m.CleanInterval <= 0 {
+		m.CleanInterval = time.Minute
+	}
+	m.records = make(map[string]memRecord)
+	m.stop = make(chan struct{})
+	go m.clean()
+	return nil
+}
+
+func (m *MemIdempotencyStore) Destroy() {
+	close(m.stop)
+}
+
+func (m *MemIdempotencyStore) clean() {
+	ticker := time.NewTicker(m.CleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			for key, r := range m.records {
+				if now.After(r.expire) {
+					delete(m.records, key)
+				}
+			}
+			m.lock.Unlock()
+		}
+	}
+}
+
+func (m *MemIdempotencyStore) Begin(key, fingerprint string, ttl time.Duration) (*IdempotentRecord, error) {
+	now := time.Now()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r, has := m.records[key]; has && now.Before(r.expire) {
+		return r.record, nil
+	}
+	m.records[key] = memRecord{
+		record: &IdempotentRecord{Fingerprint: fingerprint},
+		expire: now.Add(ttl),
+	}
+	return nil, nil
+}
+
+func (m *MemIdempotencyStore) Complete(key string, record *IdempotentRecord, ttl time.Duration) error {
+	m.lock.Lock()
+	m.records[key] = memRecord{record: record, expire: time.Now().Add(ttl)}
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *MemIdempotencyStore) Cancel(key string) error {
+	m.lock.Lock()
+	delete(m.records, key)
+	m.lock.Unlock()
+	return nil
+}
+
+var _ RedisIdempotencyCommands = (*component.Redis)(nil)
+
+func (r *RedisIdempotencyStore) Init(env zerver.Env) error {
+	rd, err := env.Component(component.REDIS)
+	if err != nil {
+		return err
+	}
+
+	store, is := rd.(RedisIdempotencyCommands)
+	if !is {
+		return errors.Err("redis component doesn't support SetNX, GetBytes, SetWithExpire and Del")
+	}
+	r.store = store
+	defval.String(&r.Prefix, "Idempotency:")
+	return nil
+}
+
+func (r *RedisIdempotencyStore) Destroy() {
+	r.store = nil
+}
+
+func ttlSeconds(ttl time.Duration) int {
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+func (r *RedisIdempotencyStore) Begin(key, fingerprint string, ttl time.Duration) (*IdempotentRecord, error) {
+	data, err := json.Marshal(&IdempotentRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	key = r.Prefix + key
+	ok, err := r.store.SetNX(key, data, ttlSeconds(ttl))
+	if err != nil || ok {
+		return nil, err
+	}
+
+	data, err = r.store.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil { // expired just now
+		return r.Begin(key[len(r.Prefix):], fingerprint, ttl)
+	}
+	var record IdempotentRecord
+	return &record, json.Unmarshal(data, &record)
+}
+
+func (r *RedisIdempotencyStore) Complete(key string, record *IdempotentRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return r.store.SetWithExpire(r.Prefix+key, data, ttlSeconds(ttl))
+}
+
+func (r *RedisIdempotencyStore) Cancel(key string) error {
+	return r.store.Del(r.Prefix + key)
+}
+
+func (w *recordWriter) Write(data []byte) (int, error) {
+	if !w.overflow {
+		if int64(w.buf.Len()+len(data)) > w.max {
+			w.overflow = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(data)
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordWriter) Flush() {
+	if flusher, is := w.ResponseWriter.(http.Flusher); is {
+		flusher.Flush()
+	}
+}
+
+func (w *recordWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, is := w.ResponseWriter.(http.Hijacker)
+	if !is {
+		return nil, nil, zerver.ErrHijack
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (w *recordWriter) Close() error {
+	if w.needClose {
+		return w.ResponseWriter.(io.Closer).Close()
+	}
+	return nil
+}
+
+func (i *Idempotency) Init(env zerver.Env) error {
+	defval.Nil(&i.Store, new(MemIdempotencyStore))
+	if err := i.Store.Init(env); err != nil {
+		return err
+	}
+	defval.String(&i.HeaderName, _HEADER_IDEMPOTENCYKEY)
+	if i.TTL <= 0 {
+		i.TTL = 24 * time.Hour
+	}
+	if len(i.Methods) == 0 {
+		i.Methods = []string{zerver.METHOD_POST, zerver.METHOD_PATCH}
+	}
+	i.methods = make(map[string]bool, len(i.Methods))
+	for _, m := range i.Methods {
+		i.methods[strings.ToUpper(m)] = true
+	}
+	if i.MaxBodySize <= 0 {
+		i.MaxBodySize = 1 << 20
+	}
+	if i.Scope == nil {
+		i.Scope = KeyByAttr(ATTR_PRINCIPAL)
+	}
+	i.log = log.Derive("Filter", "Idempotency")
+	return nil
+}
+
+func (i *Idempotency) Destroy() {
+	i.Store.Destroy()
+}
+
+// fingerprint read request body, restore it for handler, and return the
+// hash of method, path, query and body
+func (i *Idempotency) fingerprint(req zerver.Request) (string, error) {
+	var err error
+	h := sha256.New()
+	req.Wrap(func(requ *http.Request, needClose bool) (*http.Request, bool) {
+		var body []byte
+		if requ.Body != nil {
+			body, err = ioutil.ReadAll(io.LimitReader(requ.Body, i.MaxBodySize+1))
+			if err == nil && int64(len(body)) > i.MaxBodySize {
+				err = ErrBodyTooLarge
+			}
+			requ.Body.Close()
+			requ.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		io.WriteString(h, requ.Method+" "+requ.URL.Path+"?"+requ.URL.RawQuery+"\n")
+		h.Write(body)
+		return requ, needClose
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (i *Idempotency) replay(req zerver.Request, resp zerver.Response, r *IdempotentRecord) {
+	if enc := r.Header.Get(zerver.HEADER_CONTENTENCODING); enc != "" && enc != "identity" &&
+		zerver.AcceptEncoding(req.GetHeader(zerver.HEADER_ACCEPTENCODING), enc) == "" {
+		handle.SendProblem(req, resp, handle.NewProblem(http.StatusNotAcceptable, ErrIdempotencyEncoding.Error()))
+		return
+	}
+
+	headers := resp.Headers()
+	for k, v := range r.Header {
+		headers[k] = v
+	}
+	headers.Set(_HEADER_REPLAYED, "true")
+	resp.StatusCode(r.Status)
+	resp.Write(r.Body)
+}
+
+func (i *Idempotency) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	if !i.methods[req.ReqMethod()] {
+		chain(req, resp)
+		return
+	}
+
+	key := req.GetHeader(i.HeaderName)
+	if key == "" {
+		if i.Required {
+			handle.SendProblem(req, resp, handle.NewProblem(http.StatusBadRequest, ErrIdempotencyRequired.Error()))
+		} else {
+			chain(req, resp)
+		}
+		return
+	}
+	if len(key) > 255 {
+		handle.SendProblem(req, resp, handle.NewProblem(http.StatusBadRequest, "idempotency key is too long"))
+		return
+	}
+
+	fingerprint, err := i.fingerprint(req)
+	if err != nil {
+		if err == ErrBodyTooLarge {
+			handle.SendProblem(req, resp, handle.NewProblem(http.StatusRequestEntityTooLarge, err.Error()))
+		} else {
+			handle.SendProblem(req, resp, err)
+		}
+		return
+	}
+
+	logger := req.Log().For(i.log)
+	key = i.Scope(req) + "|" + key
+	record, err := i.Store.Begin(key, fingerprint, i.TTL)
+	if err != nil { // process without idempotency if store failed
+		logger.Warn(log.M{"msg": "idempotency store failed", "err": err.Error()})
+		chain(req, resp)
+		return
+	}
+	if record != nil {
+		switch {
+		case record.Fingerprint != fingerprint:
+			handle.SendProblem(req, resp, handle.NewProblem(http.StatusUnprocessableEntity, ErrIdempotencyMismatch.Error()))
+		case !record.Done:
+			resp.Headers().Set(_HEADER_RETRYAFTER, "1")
+			handle.SendProblem(req, resp, handle.NewProblem(http.StatusConflict, ErrIdempotencyInFlight.Error()))
+		default:
+			i.replay(req, resp, record)
+		}
+		return
+	}
+
+	var w *recordWriter
+	resp.Wrap(func(rw http.ResponseWriter, needClose bool) (http.ResponseWriter, bool) {
+		w = &recordWriter{ResponseWriter: rw, max: i.MaxBodySize, needClose: needClose}
+		return w, true
+	})
+
+	completed := false
+	defer func() {
+		if !completed {
+			i.Store.Cancel(key)
+		}
+	}()
+	chain(req, resp)
+
+	status := resp.StatusCode(0)
+	if status >= http.StatusInternalServerError || w.overflow || w.hijacked {
+		return
+	}
+
+	header := make(http.Header, len(resp.Headers()))
+	for k, v := range resp.Headers() {
+		if k != zerver.HEADER_SETCOOKIE {
+			header[k] = v
+		}
+	}
+	record = &IdempotentRecord{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      status,
+		Header:      header,
+		Body:        append([]byte(nil), w.buf.Bytes()...),
+	}
+	if err = i.Store.Complete(key, record, i.TTL); err != nil {
+		logger.Warn(log.M{"msg": "save idempotent response failed", "err": err.Error()})
+		return
+	}
+	completed = true
+}
@@ -0,0 +1,255 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/handle"
+)
+
+const (
+	ErrIPDenied = errors.Err("ip address is not allowed")
+
+	_IPRULE_ALLOW = "allow"
+	_IPRULE_DENY  = "deny"
+)
+
+type (
+	// IPFilter allow or deny requests by client ip(req.ClientIP), so
+	// ServerOption.TrustedProxies must be configured behind proxies.
+	//
+	// Deny rules are checked first, then if there are allow rules, ip must
+	// match one of them. Rules are CIDRs or single IPs of IPv4/IPv6.
+	//
+	// File contains extra rules, one per line as "allow 10.0.0.0/8" or
+	// "deny 2001:db8::/32", '#' start a comment. It's reloaded by Reload, or
+	// automatically when modified if WatchInterval is set.
+	// Add it to admin routes, such as the path of utils/monitor.
+	IPFilter struct {
+		Allow         []string
+		Deny          []string
+		File          string
+		WatchInterval time.Duration // interval of checking File modification, 0 means no watching
+
+		Status int // default 403
+		// ErrorHandler send the deny error, default handle.SendProblem
+		ErrorHandler func(zerver.Request, zerver.Response, error)
+
+		rules   *ipRules
+		mu      sync.RWMutex
+		modTime time.Time
+		stop    chan struct{}
+		err     error
+		log     *log.Logger
+	}
+
+	ipRule struct {
+		network *net.IPNet
+		rule    string // original rule and where it come from, for log
+	}
+
+	ipRules struct {
+		allow []ipRule
+		deny  []ipRule
+	}
+)
+
+func parseIPNet(addr string) (*net.IPNet, error) {
+	networks, err := zerver.ParseTrustedProxies(addr)
+	if err != nil {
+		return nil, err
+	}
+	return networks[0], nil
+}
+
+func (r *ipRules) add(action, addr, source string) error {
+	network, err := parseIPNet(addr)
+	if err != nil {
+		return errors.Err("invalid ip rule " + source + ": " + err.Error())
+	}
+	rule := ipRule{network: network, rule: action + " " + addr + " (" + source + ")"}
+	switch action {
+	case _IPRULE_ALLOW:
+		r.allow = append(r.allow, rule)
+	case _IPRULE_DENY:
+		r.deny = append(r.deny, rule)
+	default:
+		return errors.Err("invalid ip rule " + source + ": unknown action " + action)
+	}
+	return nil
+}
+
+func (r *ipRules) parseFile(name string, data []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		source := name + ":" + strconv.Itoa(line)
+		if len(fields) != 2 {
+			return errors.Err("invalid ip rule " + source + ": " + strings.TrimSpace(text))
+		}
+		if err := r.add(fields[0], fields[1], source); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// match return whether ip is denied, and the matched rule
+func (r *ipRules) match(ip net.IP) (bool, string) {
+	for _, rule := range r.deny {
+		if rule.network.Contains(ip) {
+			return true, rule.rule
+		}
+	}
+	if len(r.allow) == 0 {
+		return false, ""
+	}
+	for _, rule := range r.allow {
+		if rule.network.Contains(ip) {
+			return false, rule.rule
+		}
+	}
+	return true, "not in allow list"
+}
+
+func (f *IPFilter) Init(zerver.Env) error {
+	if f.Status == 0 {
+		f.Status = http.StatusForbidden
+	}
+	if f.ErrorHandler == nil {
+		f.ErrorHandler = handle.SendProblem
+	}
+	f.err = handle.NewProblem(f.Status, ErrIPDenied.Error())
+	f.log = log.Derive("Filter", "IPFilter")
+
+	if err := f.Reload(); err != nil {
+		return err
+	}
+	if f.File != "" && f.WatchInterval > 0 {
+		f.stop = make(chan struct{})
+		go f.watch(f.stop)
+	}
+	return nil
+}
+
+func (f *IPFilter) Destroy() {
+	if f.stop != nil {
+		close(f.stop)
+	}
+}
+
+// Reload rebuild rules from static lists and File, current rules are kept if
+// there is any error
+func (f *IPFilter) Reload() error {
+	rules := &ipRules{}
+	for _, addr := range f.Allow {
+		if err := rules.add(_IPRULE_ALLOW, addr, "static"); err != nil {
+			return err
+		}
+	}
+	for _, addr := range f.Deny {
+		if err := rules.add(_IPRULE_DENY, addr, "static"); err != nil {
+			return err
+		}
+	}
+
+	var modTime time.Time
+	if f.File != "" {
+		info, err := os.Stat(f.File)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(f.File)
+		if err != nil {
+			return err
+		}
+		if err = rules.parseFile(f.File, data); err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.modTime = modTime
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *IPFilter) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(f.WatchInterval)
+	defer ticker.Stop()
+
+	f.mu.RLock()
+	last := f.modTime
+	f.mu.RUnlock()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(f.File)
+		if err != nil {
+			f.log.Error(log.M{"msg": "stat ip rule file failed", "file": f.File, "err": err.Error()})
+			continue
+		}
+		if info.ModTime().Equal(last) {
+			continue
+		}
+
+		last = info.ModTime() // don't retry broken file until it's modified again
+		if err = f.Reload(); err != nil {
+			f.log.Error(log.M{"msg": "reload ip rules failed", "file": f.File, "err": err.Error()})
+		} else {
+			f.log.Info(log.M{"msg": "ip rules reloaded", "file": f.File})
+		}
+	}
+}
+
+func (f *IPFilter) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+
+	clientIP := req.ClientIP()
+	denied, rule := true, "invalid ip"
+	if ip := zerver.ParseIP(clientIP); ip != nil {
+		denied, rule = rules.match(ip)
+	}
+	if !denied {
+		chain(req, resp)
+		return
+	}
+
+	req.Log().For(f.log).Warn(log.M{
+		"msg":    "ip denied",
+		"ip":     clientIP,
+		"rule":   rule,
+		"method": req.ReqMethod(),
+		"path":   req.URL().Path,
+	})
+	resp.StatusCode(f.Status)
+	f.ErrorHandler(req, resp, f.err)
+}
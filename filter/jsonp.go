@@ -62,6 +62,6 @@ func (j *JSONP) Filter(req zerver.Request, resp zerver.Response, chain zerver.Fi
 		}
 	}
 	if err != nil {
-		j.log.Warn(log.M{"msg": "write jsonp response failed", "err": err.Error()})
+		req.Log().For(j.log).Warn(log.M{"msg": "write jsonp response failed", "err": err.Error()})
 	}
 }
@@ -0,0 +1,409 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/handle"
+)
+
+const (
+	ATTR_JWTCLAIMS = "JWTClaims"
+
+	JWT_HS256 = "HS256"
+	JWT_RS256 = "RS256"
+	JWT_ES256 = "ES256"
+
+	_HEADER_WWWAUTHENTICATE = "WWW-Authenticate"
+	_BEARER                 = "Bearer "
+
+	ErrJWTMissing   = errors.Err("bearer token is missing")
+	ErrJWTMalformed = errors.Err("token is malformed")
+	ErrJWTAlg       = errors.Err("token algorithm is not supported")
+	ErrJWTKey       = errors.Err("token key is not found")
+	ErrJWTSignature = errors.Err("token signature is invalid")
+	ErrJWTExpired   = errors.Err("token is expired")
+	ErrJWTNotBefore = errors.Err("token is not valid yet")
+	ErrJWTIssuer    = errors.Err("token issuer is invalid")
+	ErrJWTAudience  = errors.Err("token audience is invalid")
+)
+
+type (
+	// JWT verify bearer token, the claims is stored to request attribute
+	// ATTR_JWTCLAIMS, and the subject to ATTR_PRINCIPAL. Keys can be static,
+	// or loaded from a JWKS file, call Reload after the file is changed.
+	//
+	// The algorithm of token must match the key, HS256 require []byte,
+	// RS256 require *rsa.PublicKey, ES256 require *ecdsa.PublicKey of P-256.
+	JWT struct {
+		Keys     []JWTKey
+		JWKSFile string
+
+		Issuer   string        // required issuer if not empty
+		Audience string        // required audience if not empty
+		Skew     time.Duration // clock skew for exp and nbf, default 1 minute
+		Optional bool          // pass through requests without token
+
+		keys map[string][]JWTKey // kid:keys
+		mu   sync.RWMutex
+		log  *log.Logger
+	}
+
+	// JWTKey is a verification key, ID is matched with "kid" of token header if
+	// it's not empty
+	JWTKey struct {
+		ID  string
+		Alg string
+		Key interface{}
+	}
+
+	// JWTClaims is the claims of token, numbers are float64
+	JWTClaims map[string]interface{}
+
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		K   string `json:"k"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+var _JWTENCODING = base64.RawURLEncoding
+
+// Claims return claims of request, nil if request isn't authenticated by JWT
+func Claims(req zerver.Request) JWTClaims {
+	c, _ := req.Attr(ATTR_JWTCLAIMS).(JWTClaims)
+	return c
+}
+
+func (c JWTClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c JWTClaims) Subject() string {
+	return c.String("sub")
+}
+
+func (c JWTClaims) Issuer() string {
+	return c.String("iss")
+}
+
+// Audience return "aud" claim, it may be a string or string array
+func (c JWTClaims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		auds := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, is := a.(string); is {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// Time return numeric date claim, zero time if absent
+func (c JWTClaims) Time(name string) time.Time {
+	if n, is := c[name].(float64); is {
+		return time.Unix(int64(n), 0)
+	}
+	return time.Time{}
+}
+
+func (j *JWT) Init(zerver.Env) error {
+	if j.Skew == 0 {
+		j.Skew = time.Minute
+	}
+	j.log = log.Derive("Filter", "JWT")
+	return j.Reload()
+}
+
+func (j *JWT) Destroy() {}
+
+// Reload rebuild key set from static keys and JWKS file
+func (j *JWT) Reload() error {
+	keys := append([]JWTKey(nil), j.Keys...)
+	if j.JWKSFile != "" {
+		data, err := ioutil.ReadFile(j.JWKSFile)
+		if err != nil {
+			return err
+		}
+		fkeys, err := ParseJWKS(data)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, fkeys...)
+	}
+
+	m := make(map[string][]JWTKey, len(keys))
+	for _, k := range keys {
+		m[k.ID] = append(m[k.ID], k)
+	}
+	j.mu.Lock()
+	j.keys = m
+	j.mu.Unlock()
+	return nil
+}
+
+// ParseJWKS parse verification keys from JWK set, keys not used for signature
+// and unsupported keys are ignored
+func ParseJWKS(data []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]JWTKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, alg, err := k.parse()
+		if err != nil {
+			return nil, err
+		}
+		if alg == "" {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		keys = append(keys, JWTKey{ID: k.Kid, Alg: alg, Key: key})
+	}
+	return keys, nil
+}
+
+func (k *jwk) parse() (interface{}, string, error) {
+	switch k.Kty {
+	case "oct":
+		key, err := _JWTENCODING.DecodeString(k.K)
+		return key, JWT_HS256, err
+	case "RSA":
+		n, err := _JWTENCODING.DecodeString(k.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := _JWTENCODING.DecodeString(k.E)
+		if err != nil {
+			return nil, "", err
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		return key, JWT_RS256, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, "", nil
+		}
+		x, err := _JWTENCODING.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := _JWTENCODING.DecodeString(k.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return key, JWT_ES256, nil
+	}
+	return nil, "", nil
+}
+
+// Verify verify token and return it's claims
+func (j *JWT) Verify(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	sig, err := _JWTENCODING.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	switch header.Alg {
+	case JWT_HS256, JWT_RS256, JWT_ES256:
+	default:
+		return nil, ErrJWTAlg
+	}
+
+	j.mu.RLock()
+	keys := j.keys[header.Kid]
+	if header.Kid != "" {
+		keys = append(keys[:len(keys):len(keys)], j.keys[""]...) // keys without id match any kid
+	}
+	j.mu.RUnlock()
+
+	signed := token[:len(parts[0])+1+len(parts[1])]
+	err = ErrJWTKey
+	for _, key := range keys {
+		if key.Alg != header.Alg {
+			continue
+		}
+		if err = verifyJWT(header.Alg, key.Key, signed, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claims JWTClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	if err = j.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := _JWTENCODING.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWT(alg string, key interface{}, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case JWT_HS256:
+		secret, is := key.([]byte)
+		if !is {
+			return ErrJWTKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrJWTSignature
+		}
+	case JWT_RS256:
+		pub, is := key.(*rsa.PublicKey)
+		if !is {
+			return ErrJWTKey
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) != nil {
+			return ErrJWTSignature
+		}
+	case JWT_ES256:
+		pub, is := key.(*ecdsa.PublicKey)
+		if !is {
+			return ErrJWTKey
+		}
+		if len(sig) != 64 {
+			return ErrJWTSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return ErrJWTSignature
+		}
+	default:
+		return ErrJWTAlg
+	}
+	return nil
+}
+
+func (j *JWT) validate(claims JWTClaims) error {
+	now := time.Now()
+	if exp := claims.Time("exp"); !exp.IsZero() && now.After(exp.Add(j.Skew)) {
+		return ErrJWTExpired
+	}
+	if nbf := claims.Time("nbf"); !nbf.IsZero() && now.Before(nbf.Add(-j.Skew)) {
+		return ErrJWTNotBefore
+	}
+	if j.Issuer != "" && claims.Issuer() != j.Issuer {
+		return ErrJWTIssuer
+	}
+	if j.Audience != "" {
+		for _, aud := range claims.Audience() {
+			if aud == j.Audience {
+				return nil
+			}
+		}
+		return ErrJWTAudience
+	}
+	return nil
+}
+
+// bearerToken return token of Authorization: Bearer header
+func bearerToken(req zerver.Request) string {
+	auth, basic := req.Authorization()
+	if basic || len(auth) <= len(_BEARER) || !strings.EqualFold(auth[:len(_BEARER)], _BEARER) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(_BEARER):])
+}
+
+func (j *JWT) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	token := bearerToken(req)
+	if token == "" {
+		if j.Optional {
+			chain(req, resp)
+			return
+		}
+		resp.Headers().Set(_HEADER_WWWAUTHENTICATE, `Bearer`)
+		handle.SendProblem(req, resp, handle.NewProblem(http.StatusUnauthorized, ErrJWTMissing.Error()))
+		return
+	}
+
+	claims, err := j.Verify(token)
+	if err != nil {
+		if j.log.IsDebugEnable() {
+			req.Log().For(j.log).Debug(log.M{"msg": "invalid token", "ip": req.ClientIP(), "err": err.Error()})
+		}
+		resp.Headers().Set(_HEADER_WWWAUTHENTICATE, `Bearer error="invalid_token", error_description="`+err.Error()+`"`)
+		handle.SendProblem(req, resp, handle.NewProblem(http.StatusUnauthorized, err.Error()))
+		return
+	}
+
+	req.SetAttr(ATTR_JWTCLAIMS, claims)
+	if sub := claims.Subject(); sub != "" {
+		req.SetAttr(ATTR_PRINCIPAL, sub)
+	}
+	chain(req, resp)
+}
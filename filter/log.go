@@ -4,9 +4,10 @@ import (
 	"github.com/cosiner/gohper/time2"
 	log "github.com/cosiner/ygo/jsonlog"
 	"github.com/cosiner/zerver"
-	"github.com/cosiner/zerver/utils/request"
 )
 
+// Log log requests through jsonlog, use AccessLog for configurable formats
+// and files
 type Log struct {
 	log *log.Logger
 }
@@ -21,10 +22,10 @@ func (l *Log) Filter(req zerver.Request, resp zerver.Response, chain zerver.Filt
 	chain(req, resp)
 	cost := time2.Now().Sub(now)
 
-	l.log.Info(log.M{
+	req.Log().For(l.log).Info(log.M{
 		"method":     req.ReqMethod(),
 		"url":        req.URL().String(),
-		"remote":     request.RemoteAddr(req),
+		"remote":     req.ClientIP(),
 		"userAgent":  req.GetHeader(zerver.HEADER_USERAGENT),
 		"cost":       cost.String(),
 		"statusCode": resp.StatusCode(0),
@@ -0,0 +1,296 @@
+package filter
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+)
+
+const (
+	_HEADER_RATELIMIT_LIMIT     = "RateLimit-Limit"
+	_HEADER_RATELIMIT_REMAINING = "RateLimit-Remaining"
+	_HEADER_RATELIMIT_RESET     = "RateLimit-Reset"
+	_HEADER_RETRYAFTER          = "Retry-After"
+)
+
+type (
+	// RateLimit limit request rate of each key, the key is client ip by default.
+	// Rules can override limit for route patterns, so one filter can be used
+	// for all routes. Routes without rule share the default limit of a key,
+	// each route with rule has its own.
+	RateLimit struct {
+		Store  RateLimitStore // default MemRateLimitStore
+		Limit  int            // requests allowed in window, default 60
+		Window time.Duration  // default 1 minute
+		Rules  map[string]RateLimitRule
+		// Key return the limit key of request, empty key is not limited,
+		// default use client ip
+		Key func(zerver.Request) string
+
+		log *log.Logger
+	}
+
+	// RateLimitRule is the limit for a route pattern, Limit < 0 means no limit,
+	// zero fields use the value of RateLimit
+	RateLimitRule struct {
+		Limit  int
+		Window time.Duration
+	}
+
+	RateLimitStore interface {
+		zerver.Component
+		// Take consume one request for key in window, return whether it's allowed,
+		// the remaining requests and the duration to wait until reset
+		Take(key string, limit int, window time.Duration) (allowed bool, remaining int, reset time.Duration, err error)
+	}
+
+	// MemRateLimitStore is a token bucket store in memory
+	MemRateLimitStore struct {
+		CleanInterval time.Duration // interval to clean full buckets, default 1 minute
+
+		buckets map[string]*bucket
+		lock    sync.Mutex
+		stop    chan struct{}
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+		window time.Duration
+	}
+
+	// RedisRateLimitStore is a fixed window counter store depends on component.Redis,
+	// it's shared by all server instances. The redis component must implements
+	// RedisCounter, such as component.Redis with RedisOption.Do.
+	RedisRateLimitStore struct {
+		Prefix string // key prefix, default "RateLimit:"
+		store  RedisCounter
+	}
+
+	// RedisCounter is the commands RedisRateLimitStore required, it's satisfied
+	// by component.Redis, or any stand-in for testing
+	RedisCounter interface {
+		Incr(key string) (int64, error)
+		Expire(key string, seconds int) error
+	}
+)
+
+// KeyByIP use client ip as limit key
+func KeyByIP(req zerver.Request) string {
+	return req.ClientIP()
+}
+
+// KeyByAttr use request attribute such as authenticated user as limit key,
+// if attribute is absent, client ip is used
+func KeyByAttr(name string) func(zerver.Request) string {
+	return func(req zerver.Request) string {
+		if v, is := req.Attr(name).(string); is && v != "" {
+			return name + ":" + v
+		}
+		return req.ClientIP()
+	}
+}
+
+func (m *MemRateLimitStore) Init(zerver.Env) error {
+	if m.CleanInterval <= 0 {
+		m.CleanInterval = time.Minute
+	}
+	m.buckets = make(map[string]*bucket)
+	m.stop = make(chan struct{})
+	go m.clean()
+
+	return nil
+}
+
+func (m *MemRateLimitStore) Destroy() {
+	close(m.stop)
+}
+
+// clean remove buckets already full, they are same as absent
+func (m *MemRateLimitStore) clean() {
+	ticker := time.NewTicker(m.CleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			for key, b := range m.buckets {
+				if now.Sub(b.last) >= b.window {
+					delete(m.buckets, key)
+				}
+			}
+			m.lock.Unlock()
+		}
+	}
+}
+
+func (m *MemRateLimitStore) Take(key string, limit int, window time.Duration) (bool, int, time.Duration, error) {
+	now := time.Now()
+
+	m.lock.Lock()
+	b := m.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(limit), last: now, window: window}
+		m.buckets[key] = b
+	}
+	allowed, remaining, reset := b.take(limit, window, now)
+	m.lock.Unlock()
+
+	return allowed, remaining, reset, nil
+}
+
+// take refill tokens elapsed since last take, then consume one token
+func (b *bucket) take(limit int, window time.Duration, now time.Time) (bool, int, time.Duration) {
+	rate := float64(limit) / float64(window) // tokens per nanosecond
+	if now.After(b.last) {
+		b.tokens = math.Min(float64(limit), b.tokens+float64(now.Sub(b.last))*rate)
+		b.last = now
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	var reset time.Duration
+	if allowed {
+		reset = time.Duration((float64(limit) - b.tokens) / rate) // until full
+	} else {
+		reset = time.Duration((1 - b.tokens) / rate) // until next token
+	}
+	return allowed, int(b.tokens), reset
+}
+
+var _ RedisCounter = (*component.Redis)(nil)
+
+func (r *RedisRateLimitStore) Init(env zerver.Env) error {
+	rd, err := env.Component(component.REDIS)
+	if err != nil {
+		return err
+	}
+
+	store, is := rd.(RedisCounter)
+	if !is {
+		return errors.Err("redis component doesn't support Incr and Expire")
+	}
+	r.store = store
+	defval.String(&r.Prefix, "RateLimit:")
+
+	return nil
+}
+
+func (r *RedisRateLimitStore) Destroy() {
+	r.store = nil
+}
+
+func (r *RedisRateLimitStore) Take(key string, limit int, window time.Duration) (bool, int, time.Duration, error) {
+	index, reset := fixedWindow(time.Now(), window)
+	key = r.Prefix + key + ":" + strconv.FormatInt(index, 10)
+	count, err := r.store.Incr(key)
+	if err != nil {
+		return true, limit, 0, err
+	}
+	if count == 1 {
+		secs := int(math.Ceil(window.Seconds()))
+		if err = r.store.Expire(key, secs); err != nil {
+			return true, limit, 0, err
+		}
+	}
+
+	remaining := limit - int(count)
+	if remaining < 0 {
+		return false, 0, reset, nil
+	}
+	return true, remaining, reset, nil
+}
+
+// fixedWindow return the index of window contains now, and the duration until
+// next window
+func fixedWindow(now time.Time, window time.Duration) (int64, time.Duration) {
+	nanos := now.UnixNano()
+	index := nanos / int64(window)
+	return index, time.Duration((index+1)*int64(window) - nanos)
+}
+
+func (l *RateLimit) Init(env zerver.Env) error {
+	defval.Nil(&l.Store, new(MemRateLimitStore))
+	if err := l.Store.Init(env); err != nil {
+		return err
+	}
+	if l.Limit == 0 {
+		l.Limit = 60
+	}
+	if l.Window <= 0 {
+		l.Window = time.Minute
+	}
+	if l.Key == nil {
+		l.Key = KeyByIP
+	}
+	l.log = log.Derive("Filter", "RateLimit")
+
+	return nil
+}
+
+func (l *RateLimit) Destroy() {
+	l.Store.Destroy()
+}
+
+// rule return the limit for pattern, and whether a rule is matched
+func (l *RateLimit) rule(pattern string) (int, time.Duration, bool) {
+	if rule, has := l.Rules[pattern]; has {
+		limit, window := rule.Limit, rule.Window
+		if limit == 0 {
+			limit = l.Limit
+		}
+		if window <= 0 {
+			window = l.Window
+		}
+		return limit, window, true
+	}
+
+	return l.Limit, l.Window, false
+}
+
+func (l *RateLimit) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	limit, window, matched := l.rule(req.Pattern())
+	key := l.Key(req)
+	if limit < 0 || key == "" {
+		chain(req, resp)
+		return
+	}
+	if matched {
+		key = req.Pattern() + "|" + key
+	}
+
+	allowed, remaining, reset, err := l.Store.Take(key, limit, window)
+	if err != nil { // don't reject requests if store failed
+		req.Log().For(l.log).Warn(log.M{"msg": "rate limit store failed", "err": err.Error()})
+		chain(req, resp)
+		return
+	}
+
+	resetSecs := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	headers := resp.Headers()
+	headers.Set(_HEADER_RATELIMIT_LIMIT, strconv.Itoa(limit))
+	headers.Set(_HEADER_RATELIMIT_REMAINING, strconv.Itoa(remaining))
+	headers.Set(_HEADER_RATELIMIT_RESET, resetSecs)
+
+	if !allowed {
+		headers.Set(_HEADER_RETRYAFTER, resetSecs)
+		resp.StatusCode(http.StatusTooManyRequests)
+		return
+	}
+
+	chain(req, resp)
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name      string
+		tokens    float64
+		elapsed   time.Duration
+		allowed   bool
+		remaining int
+		reset     time.Duration
+	}{
+		{"full", 10, 0, true, 9, 6 * time.Second},
+		{"last token", 1, 0, true, 0, time.Minute},
+		{"empty", 0, 0, false, 0, 6 * time.Second},
+		{"half token", 0.5, 0, false, 0, 3 * time.Second},
+		{"refill one", 0, 6 * time.Second, true, 0, time.Minute},
+		{"refill half window", 0, 30 * time.Second, true, 4, 36 * time.Second},
+		{"refill capped", 5, 10 * time.Minute, true, 9, 6 * time.Second},
+		{"clock backward", 0, -time.Minute, false, 0, 6 * time.Second},
+	}
+
+	for _, tt := range tests {
+		b := &bucket{tokens: tt.tokens, last: start, window: time.Minute}
+		allowed, remaining, reset := b.take(10, time.Minute, start.Add(tt.elapsed))
+		if allowed != tt.allowed || remaining != tt.remaining || reset != tt.reset {
+			t.Errorf("%s: got (%t, %d, %s), expect (%t, %d, %s)",
+				tt.name, allowed, remaining, reset, tt.allowed, tt.remaining, tt.reset)
+		}
+	}
+}
+
+func TestMemRateLimitStore(t *testing.T) {
+	m := &MemRateLimitStore{}
+	if err := m.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Destroy()
+
+	for i := 0; i < 5; i++ {
+		allowed, remaining, _, err := m.Take("a", 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := i < 3; allowed != expect {
+			t.Errorf("take %d: allowed %t, expect %t", i, allowed, expect)
+		}
+		if expect := 2 - i; expect >= 0 && remaining != expect {
+			t.Errorf("take %d: remaining %d, expect %d", i, remaining, expect)
+		}
+	}
+
+	if allowed, _, _, _ := m.Take("b", 3, time.Hour); !allowed {
+		t.Error("keys should be limited separately")
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	tests := []struct {
+		now    time.Time
+		window time.Duration
+		index  int64
+		reset  time.Duration
+	}{
+		{time.Unix(0, 0), time.Minute, 0, time.Minute},
+		{time.Unix(59, 0), time.Minute, 0, time.Second},
+		{time.Unix(60, 0), time.Minute, 1, time.Minute},
+		{time.Unix(90, 0), time.Minute, 1, 30 * time.Second},
+		{time.Unix(3601, 500), time.Hour, 1, time.Hour - time.Second - 500},
+	}
+
+	for _, tt := range tests {
+		index, reset := fixedWindow(tt.now, tt.window)
+		if index != tt.index || reset != tt.reset {
+			t.Errorf("%s in %s: got (%d, %s), expect (%d, %s)",
+				tt.now.UTC(), tt.window, index, reset, tt.index, tt.reset)
+		}
+	}
+}
+
+type fakeRedisCounter struct {
+	counts  map[string]int64
+	expires map[string]int
+	err     error
+}
+
+func newFakeRedisCounter() *fakeRedisCounter {
+	return &fakeRedisCounter{
+		counts:  make(map[string]int64),
+		expires: make(map[string]int),
+	}
+}
+
+func (f *fakeRedisCounter) Incr(key string) (int64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.counts[key]++
+	return f.counts[key], nil
+}
+
+func (f *fakeRedisCounter) Expire(key string, seconds int) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.expires[key] = seconds
+	return nil
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	counter := newFakeRedisCounter()
+	r := &RedisRateLimitStore{Prefix: "RL:", store: counter}
+
+	tests := []struct {
+		allowed   bool
+		remaining int
+	}{
+		{true, 1},
+		{true, 0},
+		{false, 0},
+		{false, 0},
+	}
+	for i, tt := range tests {
+		allowed, remaining, reset, err := r.Take("a", 2, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != tt.allowed || remaining != tt.remaining {
+			t.Errorf("take %d: got (%t, %d), expect (%t, %d)", i, allowed, remaining, tt.allowed, tt.remaining)
+		}
+		if !tt.allowed && (reset <= 0 || reset > time.Hour) {
+			t.Errorf("take %d: reset %s out of window", i, reset)
+		}
+	}
+
+	if len(counter.expires) != 1 {
+		t.Fatalf("expire should be set once for the window, got %v", counter.expires)
+	}
+	for key, secs := range counter.expires {
+		if !strings.HasPrefix(key, "RL:a:") {
+			t.Errorf("unexpected key %s", key)
+		}
+		if secs != 3600 {
+			t.Errorf("expire %d, expect 3600", secs)
+		}
+	}
+
+	counter.err = errors.New("connection refused")
+	allowed, remaining, _, err := r.Take("b", 2, time.Hour)
+	if err == nil || !allowed || remaining != 2 {
+		t.Errorf("store error should allow request, got (%t, %d, %v)", allowed, remaining, err)
+	}
+}
@@ -5,18 +5,30 @@ import (
 
 	"github.com/cosiner/gohper/runtime2"
 	"github.com/cosiner/gohper/utils/defval"
-	log "github.com/cosiner/ygo/jsonlog"
 	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/handle"
 )
 
+// Recovery recover panics of handlers, the panic is passed to PanicHandler,
+// then ErrorHandler send the 500 response. If response is already committed,
+// the connection is aborted by http.ErrAbortHandler, so client won't take
+// the partial response as a complete one. A *zerver.Panic re-panicked from
+// other goroutine such as by Timeout is reported as is, so it keeps the stack.
 type Recovery struct {
-	Bufsize int
-	log     *log.Logger
+	Bufsize int // stack buffer size, default 4K
+
+	// PanicHandler report panic, such as to an error tracker, default
+	// Server.HandlePanic, which log it and call ServerOption.OnPanic
+	PanicHandler func(*zerver.Panic)
+	// ErrorHandler send the 500 response, default handle.SendProblem
+	ErrorHandler func(zerver.Request, zerver.Response, error)
 }
 
 func (r *Recovery) Init(env zerver.Env) error {
 	defval.Int(&r.Bufsize, 1024*4)
-	r.log = log.Derive("Filter", "Recovery")
+	if r.ErrorHandler == nil {
+		r.ErrorHandler = handle.SendProblem
+	}
 	return nil
 }
 
@@ -24,12 +36,35 @@ func (r *Recovery) Destroy() {}
 
 func (r *Recovery) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
 	defer func() {
-		if err := recover(); err != nil {
-			stack := runtime2.Stack(r.Bufsize, false)
-			resp.StatusCode(http.StatusInternalServerError)
-			r.log.Raw(0, log.LEVEL_ERROR, string(stack))
+		v := recover()
+		if v == nil {
 			return
 		}
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+
+		p, is := v.(*zerver.Panic)
+		if !is {
+			p = &zerver.Panic{
+				Source:        zerver.PANIC_HTTP,
+				Pattern:       req.Pattern(),
+				CorrelationID: req.CorrelationID(),
+				Value:         v,
+				Stack:         runtime2.Stack(r.Bufsize, false),
+				Request:       req,
+			}
+		}
+		if r.PanicHandler != nil {
+			r.PanicHandler(p)
+		} else {
+			req.Server().HandlePanic(p)
+		}
+
+		if resp.Committed() {
+			panic(http.ErrAbortHandler)
+		}
+		r.ErrorHandler(req, resp, handle.NewProblem(http.StatusInternalServerError, ""))
 	}()
 	chain(req, resp)
 }
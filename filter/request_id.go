@@ -5,7 +5,6 @@ import (
 	"sync"
 
 	"github.com/cosiner/gohper/errors"
-	"github.com/cosiner/gohper/net2/http2"
 	"github.com/cosiner/gohper/utils/defval"
 	"github.com/cosiner/kv"
 	log "github.com/cosiner/ygo/jsonlog"
@@ -20,6 +19,8 @@ const (
 type (
 	// RequestId is a simple filter prevent application/user from overlap request
 	// the request id is generated by client itself or other server components.
+	// The id is forgotten after request completed, use Idempotency to make
+	// client retries safe.
 	RequestId struct {
 		Store         IDStore
 		HeaderName    string
@@ -136,12 +137,12 @@ func (ri *RequestId) Filter(req zerver.Request, resp zerver.Response, chain zerv
 			resp.StatusCode(http.StatusBadRequest)
 		}
 	} else {
-		ip := http2.IpOfAddr(req.RemoteAddr())
+		ip := req.ClientIP()
 		id := ip + ":" + reqId
 		if err := ri.Store.Save(id); err == ErrRequestIDExist {
 			resp.StatusCode(http.StatusForbidden)
 		} else if err != nil {
-			ri.log.Warn(log.M{"msg": "save request id failed", "err": err.Error()})
+			req.Log().For(ri.log).Warn(log.M{"msg": "save request id failed", "err": err.Error()})
 		} else {
 			chain(req, resp)
 			ri.Store.Remove(id)
@@ -0,0 +1,342 @@
+package filter
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/defval"
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+)
+
+const (
+	// presets of SecurityPolicy
+	SECURITY_WEB  = "web"
+	SECURITY_API  = "api"
+	SECURITY_NONE = "none" // no preset, only the fields set
+
+	_HEADER_HSTS                 = "Strict-Transport-Security"
+	_HEADER_CSP                  = "Content-Security-Policy"
+	_HEADER_CSPREPORTONLY        = "Content-Security-Policy-Report-Only"
+	_HEADER_FRAMEOPTIONS         = "X-Frame-Options"
+	_HEADER_CONTENTTYPEOPTIONS   = "X-Content-Type-Options"
+	_HEADER_REFERRERPOLICY       = "Referrer-Policy"
+	_HEADER_PERMISSIONSPOLICY    = "Permissions-Policy"
+	_HEADER_CROSSORIGINOPENER    = "Cross-Origin-Opener-Policy"
+	_HEADER_REPORTINGENDPOINTS   = "Reporting-Endpoints"
+	_CSP_NONCE_PLACEHOLDER       = "{nonce}"
+	_CSP_REPORT_GROUP            = "csp"
+	_CSP_REPORT_MAXSIZE          = 64 << 10
+	_SECURITY_DISABLED           = "-"
+	_CONTENTTYPE_REPORTS         = "application/reports+json"
+	_REPORTTYPE_CSPVIOLATION     = "csp-violation"
+	_SECURITY_PERMISSIONS_DENIED = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+)
+
+const (
+	ErrUnknownSecurityPreset = errors.Err("unknown security preset")
+)
+
+var securityPresets = map[string]SecurityPolicy{
+	SECURITY_NONE: {},
+	SECURITY_WEB: {
+		HSTS: "max-age=31536000; includeSubDomains",
+		CSP: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; " +
+			"img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'",
+		FrameOptions:            "SAMEORIGIN",
+		ContentTypeOptions:      "nosniff",
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		PermissionsPolicy:       _SECURITY_PERMISSIONS_DENIED,
+		CrossOriginOpenerPolicy: "same-origin",
+	},
+	// api responses are not rendered, lock everything down
+	SECURITY_API: {
+		HSTS:               "max-age=31536000; includeSubDomains",
+		CSP:                "default-src 'none'; frame-ancestors 'none'",
+		FrameOptions:       "DENY",
+		ContentTypeOptions: "nosniff",
+		ReferrerPolicy:     "no-referrer",
+	},
+}
+
+type (
+	// SecurityPolicy is the security headers of a route group, empty fields
+	// are filled from Preset, "-" disable the header. Preset of default
+	// policy is SECURITY_WEB if empty, route policies inherit it.
+	//
+	// "{nonce}" in CSP is replaced by a random nonce per request, it's
+	// available by component.CSPNonce and template function cspNonce.
+	SecurityPolicy struct {
+		Preset                  string `json:"preset"` // SECURITY_WEB, SECURITY_API, SECURITY_NONE
+		HSTS                    string `json:"hsts"`
+		CSP                     string `json:"csp"`
+		CSPReportOnly           bool   `json:"cspReportOnly"` // send CSP as Content-Security-Policy-Report-Only
+		FrameOptions            string `json:"frameOptions"`
+		ContentTypeOptions      string `json:"contentTypeOptions"`
+		ReferrerPolicy          string `json:"referrerPolicy"`
+		PermissionsPolicy       string `json:"permissionsPolicy"`
+		CrossOriginOpenerPolicy string `json:"crossOriginOpenerPolicy"`
+
+		headers  [][2]string // static headers
+		cspName  string
+		csp      string
+		cspNonce bool
+	}
+
+	// SecurityHeaders set security headers by policy of request path, unlike
+	// ServerOption.Headers, html pages and apis can use different policies.
+	//
+	// Routes is policies keyed by path prefix, the longest prefix matched on
+	// segment boundary is used. If ReportPath is set, report-uri/report-to is added to CSP, and
+	// reports sent to it is collected by filter and passed to ReportHandler,
+	// filter must be added to ReportPath, such as global filter.
+	SecurityHeaders struct {
+		SecurityPolicy
+		Routes map[string]*SecurityPolicy
+
+		ReportPath string
+		// ReportHandler handle csp violation reports, default log it
+		ReportHandler func(zerver.Request, *CSPReport)
+
+		routes []string // prefixes sorted by length desc
+		log    *log.Logger
+	}
+
+	// CSPReport is a csp violation report, both report-uri and report-to
+	// formats are parsed to it
+	CSPReport struct {
+		DocumentURI        string `json:"document-uri"`
+		Referrer           string `json:"referrer"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		OriginalPolicy     string `json:"original-policy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		StatusCode         int    `json:"status-code"`
+	}
+
+	// cspViolation is the body of report-to reports
+	cspViolation struct {
+		DocumentURL        string `json:"documentURL"`
+		Referrer           string `json:"referrer"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		OriginalPolicy     string `json:"originalPolicy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+		StatusCode         int    `json:"statusCode"`
+	}
+)
+
+func securityField(field *string, preset string) {
+	if *field == "" {
+		*field = preset
+	}
+}
+
+func (p *SecurityPolicy) init(defPreset, reportPath string) error {
+	defval.String(&p.Preset, defPreset)
+	preset, has := securityPresets[p.Preset]
+	if !has {
+		return errors.Err(ErrUnknownSecurityPreset.Error() + ": " + p.Preset)
+	}
+	securityField(&p.HSTS, preset.HSTS)
+	securityField(&p.CSP, preset.CSP)
+	securityField(&p.FrameOptions, preset.FrameOptions)
+	securityField(&p.ContentTypeOptions, preset.ContentTypeOptions)
+	securityField(&p.ReferrerPolicy, preset.ReferrerPolicy)
+	securityField(&p.PermissionsPolicy, preset.PermissionsPolicy)
+	securityField(&p.CrossOriginOpenerPolicy, preset.CrossOriginOpenerPolicy)
+
+	p.headers = p.headers[:0]
+	for _, h := range [][2]string{
+		{_HEADER_HSTS, p.HSTS},
+		{_HEADER_FRAMEOPTIONS, p.FrameOptions},
+		{_HEADER_CONTENTTYPEOPTIONS, p.ContentTypeOptions},
+		{_HEADER_REFERRERPOLICY, p.ReferrerPolicy},
+		{_HEADER_PERMISSIONSPOLICY, p.PermissionsPolicy},
+		{_HEADER_CROSSORIGINOPENER, p.CrossOriginOpenerPolicy},
+	} {
+		if h[1] != "" && h[1] != _SECURITY_DISABLED {
+			p.headers = append(p.headers, h)
+		}
+	}
+
+	p.csp, p.cspNonce = "", false
+	if p.CSP == "" || p.CSP == _SECURITY_DISABLED {
+		return nil
+	}
+	p.cspName = _HEADER_CSP
+	if p.CSPReportOnly {
+		p.cspName = _HEADER_CSPREPORTONLY
+	}
+	p.csp = strings.TrimRight(strings.TrimSpace(p.CSP), ";")
+	if reportPath != "" && !strings.Contains(p.csp, "report-uri") {
+		p.csp += "; report-uri " + reportPath + "; report-to " + _CSP_REPORT_GROUP
+	}
+	p.cspNonce = strings.Contains(p.csp, _CSP_NONCE_PLACEHOLDER)
+	return nil
+}
+
+func (s *SecurityHeaders) Init(zerver.Env) error {
+	if s.ReportHandler == nil {
+		s.ReportHandler = s.logReport
+	}
+	s.log = log.Derive("Filter", "SecurityHeaders")
+
+	if err := s.SecurityPolicy.init(SECURITY_WEB, s.ReportPath); err != nil {
+		return err
+	}
+	s.routes = s.routes[:0]
+	for prefix, p := range s.Routes {
+		if err := p.init(s.Preset, s.ReportPath); err != nil {
+			return err
+		}
+		s.routes = append(s.routes, prefix)
+	}
+	sort.Slice(s.routes, func(i, j int) bool {
+		return len(s.routes[i]) > len(s.routes[j])
+	})
+	return nil
+}
+
+func (s *SecurityHeaders) Destroy() {}
+
+func (s *SecurityHeaders) policy(path string) *SecurityPolicy {
+	for _, prefix := range s.routes {
+		if hasPathPrefix(path, prefix) {
+			return s.Routes[prefix]
+		}
+	}
+	return &s.SecurityPolicy
+}
+
+func newCSPNonce() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+func (s *SecurityHeaders) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	path := req.URL().Path
+	if s.ReportPath != "" && path == s.ReportPath {
+		s.collectReport(req, resp)
+		return
+	}
+
+	p := s.policy(path)
+	headers := resp.Headers()
+	for _, h := range p.headers {
+		headers.Set(h[0], h[1])
+	}
+	if p.csp != "" {
+		csp := p.csp
+		if p.cspNonce {
+			nonce := newCSPNonce()
+			req.SetAttr(component.ATTR_CSPNONCE, nonce)
+			csp = strings.Replace(csp, _CSP_NONCE_PLACEHOLDER, nonce, -1)
+		}
+		headers.Set(p.cspName, csp)
+		if s.ReportPath != "" {
+			headers.Set(_HEADER_REPORTINGENDPOINTS, _CSP_REPORT_GROUP+`="`+s.ReportPath+`"`)
+		}
+	}
+	chain(req, resp)
+}
+
+// collectReport accept reports of both report-uri(application/csp-report)
+// and report-to(application/reports+json), always answer 204 so browsers
+// won't retry
+func (s *SecurityHeaders) collectReport(req zerver.Request, resp zerver.Response) {
+	if req.ReqMethod() != zerver.METHOD_POST {
+		resp.StatusCode(http.StatusMethodNotAllowed)
+		return
+	}
+	resp.StatusCode(http.StatusNoContent)
+
+	body, err := ioutil.ReadAll(io.LimitReader(req, _CSP_REPORT_MAXSIZE))
+	if err != nil {
+		return
+	}
+	reports, err := parseCSPReports(req.GetHeader(zerver.HEADER_CONTENTTYPE), body)
+	if err != nil {
+		if s.log.IsDebugEnable() {
+			req.Log().For(s.log).Debug(log.M{"msg": "invalid csp report", "ip": req.ClientIP(), "err": err.Error()})
+		}
+		return
+	}
+	for _, r := range reports {
+		s.ReportHandler(req, r)
+	}
+}
+
+func parseCSPReports(contentType string, body []byte) ([]*CSPReport, error) {
+	if strings.HasPrefix(contentType, _CONTENTTYPE_REPORTS) {
+		var reports []struct {
+			Type string       `json:"type"`
+			Body cspViolation `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+
+		res := make([]*CSPReport, 0, len(reports))
+		for i := range reports {
+			if reports[i].Type != _REPORTTYPE_CSPVIOLATION {
+				continue
+			}
+			b := &reports[i].Body
+			res = append(res, &CSPReport{
+				DocumentURI:        b.DocumentURL,
+				Referrer:           b.Referrer,
+				BlockedURI:         b.BlockedURL,
+				ViolatedDirective:  b.EffectiveDirective,
+				EffectiveDirective: b.EffectiveDirective,
+				OriginalPolicy:     b.OriginalPolicy,
+				Disposition:        b.Disposition,
+				SourceFile:         b.SourceFile,
+				LineNumber:         b.LineNumber,
+				StatusCode:         b.StatusCode,
+			})
+		}
+		return res, nil
+	}
+
+	// application/csp-report, some browsers send it as application/json
+	var report struct {
+		CSPReport *CSPReport `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	if report.CSPReport == nil {
+		return nil, errors.Err("csp-report is absent")
+	}
+	return []*CSPReport{report.CSPReport}, nil
+}
+
+func (s *SecurityHeaders) logReport(req zerver.Request, r *CSPReport) {
+	req.Log().For(s.log).Warn(log.M{
+		"msg":         "csp violation",
+		"document":    r.DocumentURI,
+		"blocked":     r.BlockedURI,
+		"directive":   r.EffectiveDirective,
+		"disposition": r.Disposition,
+		"source":      r.SourceFile,
+		"line":        r.LineNumber,
+		"ip":          req.ClientIP(),
+	})
+}
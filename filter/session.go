@@ -0,0 +1,40 @@
+package filter
+
+import (
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/component"
+)
+
+// Session load session for request by component.Sessions, handlers access it
+// by req.Session(). If Sessions is nil, the registered component.SESSION is used.
+type Session struct {
+	Sessions *component.Sessions
+
+	owned bool
+}
+
+func (s *Session) Init(env zerver.Env) error {
+	if s.Sessions != nil {
+		s.owned = true
+		return s.Sessions.Init(env)
+	}
+
+	comp, err := env.Component(component.SESSION)
+	if err != nil {
+		return err
+	}
+	s.Sessions = comp.(*component.Sessions)
+	return nil
+}
+
+func (s *Session) Destroy() {
+	if s.owned {
+		s.Sessions.Destroy()
+	}
+}
+
+func (s *Session) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	commit := s.Sessions.Start(req, resp)
+	chain(req, resp)
+	commit()
+}
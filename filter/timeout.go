@@ -0,0 +1,208 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+	"github.com/cosiner/zerver/utils/handle"
+)
+
+const (
+	ErrHandlerTimeout = errors.Err("handler timeout")
+)
+
+// Timeout give handler a deadline through request context, handler's output
+// is buffered, if it's not finished in time, the buffered output is
+// discarded, an error is sent by ErrorHandler, and late writes of handler
+// return ErrHandlerTimeout.
+//
+// After timeout the filter return without waiting for handler, request is
+// detached and recycled once handler returns, handler should return once
+// req.Context() is done. Panic of handler is re-panicked as a *zerver.Panic
+// with the handler's stack, or passed to Server.HandlePanic if it's after
+// timeout. Hijack and Flush are not supported by the buffered response,
+// disable timeout for websocket and streaming routes by a negative value in
+// Routes.
+type Timeout struct {
+	Timeout time.Duration            // default 30s
+	Routes  map[string]time.Duration // timeout for route pattern, negative means no timeout
+	Status  int                      // status of timeout, 503 or 504, default 503
+
+	// ErrorHandler send the timeout error, the response status is already set
+	// to Status, default handle.SendErr. Request is still used by handler, so
+	// it's not passed, the error is a problem whose instance is request path.
+	ErrorHandler func(zerver.Response, error)
+
+	problem *handle.Problem
+}
+
+func (t *Timeout) Init(zerver.Env) error {
+	if t.Timeout <= 0 {
+		t.Timeout = 30 * time.Second
+	}
+	if t.Status == 0 {
+		t.Status = http.StatusServiceUnavailable
+	}
+	if t.ErrorHandler == nil {
+		t.ErrorHandler = handle.SendErr
+	}
+	t.problem = handle.NewProblem(t.Status, ErrHandlerTimeout.Error())
+	return nil
+}
+
+func (t *Timeout) Destroy() {}
+
+func (t *Timeout) timeout(pattern string) time.Duration {
+	if d, has := t.Routes[pattern]; has {
+		return d
+	}
+	return t.Timeout
+}
+
+func (t *Timeout) Filter(req zerver.Request, resp zerver.Response, chain zerver.FilterChain) {
+	d := t.timeout(req.Pattern())
+	if d <= 0 {
+		chain(req, resp)
+		return
+	}
+
+	var origin *http.Request
+	var cancel context.CancelFunc
+	req.Wrap(func(requ *http.Request, needClose bool) (*http.Request, bool) {
+		origin = requ
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(requ.Context(), d)
+		return requ.WithContext(ctx), needClose
+	})
+	restore := func() {
+		cancel()
+		req.Wrap(func(_ *http.Request, needClose bool) (*http.Request, bool) {
+			return origin, needClose
+		})
+	}
+
+	// req is shared with handler goroutine, read all needed before start it
+	ctx := req.Context()
+	accept := req.GetHeader(zerver.HEADER_ACCEPT)
+	problem := *t.problem
+	problem.Instance = req.URL().Path
+
+	w := newTimeoutWriter(resp.Headers())
+	hresp := zerver.NewResponse(resp, w, accept)
+
+	done := make(chan struct{})
+	var panicked *zerver.Panic
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				panicked = zerver.NewPanic(zerver.PANIC_HTTP, req.Pattern(), v)
+				panicked.CorrelationID = req.CorrelationID()
+				panicked.Request = req
+			}
+			close(done)
+		}()
+		chain(req, hresp)
+	}()
+
+	select {
+	case <-done:
+		restore()
+		if panicked != nil {
+			panic(panicked)
+		}
+		w.timeout() // handler may leave goroutines write to it
+		resp.SetValue(hresp.Value())
+		w.copyTo(resp, hresp.StatusCode(0))
+	case <-ctx.Done():
+		w.timeout()
+
+		ew := newTimeoutWriter(resp.Headers())
+		eresp := zerver.NewResponse(resp, ew, accept)
+		eresp.StatusCode(t.Status)
+		t.ErrorHandler(eresp, &problem)
+		ew.copyTo(resp, eresp.StatusCode(0))
+		resp.Flush()
+
+		release := req.Detach()
+		go func() {
+			<-done
+			if panicked != nil {
+				req.Server().HandlePanic(panicked)
+			}
+			restore()
+			release()
+		}()
+	}
+}
+
+// timeoutWriter buffer handler output, after timeout, writes are rejected
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	buf      bytes.Buffer
+	timedOut bool
+}
+
+func newTimeoutWriter(header http.Header) *timeoutWriter {
+	h := make(http.Header, len(header))
+	for k, v := range header {
+		h[k] = append([]string(nil), v...)
+	}
+	return &timeoutWriter{header: h}
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	if !w.timedOut && w.status == 0 {
+		w.status = status
+	}
+	w.mu.Unlock()
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+	return w.buf.Write(data)
+}
+
+func (w *timeoutWriter) timeout() {
+	w.mu.Lock()
+	w.timedOut = true
+	w.mu.Unlock()
+}
+
+// copyTo copy buffered headers and body to response, status is used if
+// WriteHeader is never called
+func (w *timeoutWriter) copyTo(resp zerver.Response, status int) {
+	if w.status != 0 {
+		status = w.status
+	}
+
+	headers := resp.Headers()
+	for k := range headers {
+		delete(headers, k)
+	}
+	for k, v := range w.header {
+		headers[k] = v
+	}
+	if w.buf.Len() != 0 {
+		headers.Set(zerver.HEADER_CONTENTLENGTH, strconv.Itoa(w.buf.Len()))
+	}
+
+	resp.StatusCode(status)
+	resp.Write(w.buf.Bytes())
+}
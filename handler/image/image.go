@@ -145,8 +145,9 @@ func (h *Handler) Handle(req zerver.Request, resp zerver.Response) {
 		}
 		defer fd.Close()
 
-		if h.log.IsDebugEnable() {
-			h.log.Debug(log.M{"msg": "file upload", "filename": fd.Filename(), "bytes": fd.Size()})
+		logger := req.Log().For(h.log)
+		if logger.IsDebugEnable() {
+			logger.Debug(log.M{"msg": "file upload", "filename": fd.Filename(), "bytes": fd.Size()})
 		}
 
 		path, err := h.SaveImage(fd, req)
@@ -158,7 +159,7 @@ func (h *Handler) Handle(req zerver.Request, resp zerver.Response) {
 		if h.PostDo != nil {
 			err := h.PostDo(req)
 			if err != nil {
-				h.log.Warn(log.M{"msg": "call post do failed", "err": err.Error()})
+				logger.Warn(log.M{"msg": "call post do failed", "err": err.Error()})
 			}
 		}
 
@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+)
+
+// Static serve files under a directory or a fs.FS, it should be registered
+// under a catch-all pattern such as "/static/*filepath".
+//
+// Range requests and conditional requests are handled by http.ServeContent,
+// strong ETag is generated from file size and modify time. If client accept
+// gzip and there is a "name.gz" file, it will be served instead. Directories
+// are redirected to path with trailing slash as http.FileServer.
+type Static struct {
+	Dir     string        // directory, relative path is resolved by Env.Filepath
+	FS      fs.FS         // if not nil, Dir is ignored
+	PathVar string        // name of catch-all variable, default "filepath"
+	Index   []string      // index files for directory, default ["index.html"]
+	SPA     bool          // serve root index file if file not found, for single page application
+	MaxAge  time.Duration // Cache-Control max-age, 0 to disable
+	Gzip    bool          // serve precompressed .gz files
+
+	cacheControl string
+}
+
+func (s *Static) Init(env zerver.Env) error {
+	if s.FS == nil {
+		if s.Dir == "" {
+			return errors.Err("static file directory or fs should not be empty")
+		}
+		s.FS = os.DirFS(env.Filepath(s.Dir))
+	}
+	if s.PathVar == "" {
+		s.PathVar = "filepath"
+	}
+	if s.Index == nil {
+		s.Index = []string{"index.html"}
+	}
+	if s.MaxAge > 0 {
+		s.cacheControl = "public, max-age=" + strconv.Itoa(int(s.MaxAge/time.Second))
+	}
+
+	return nil
+}
+
+func (s *Static) Destroy() {}
+
+func (s *Static) Handler(method string) zerver.HandleFunc {
+	if method == zerver.METHOD_GET || method == zerver.METHOD_HEAD {
+		return s.Serve
+	}
+
+	return nil
+}
+
+func (s *Static) Serve(req zerver.Request, resp zerver.Response) {
+	name, ok := cleanPath(req.Vars().URLVar(s.PathVar))
+	if !ok {
+		resp.StatusCode(http.StatusBadRequest)
+		return
+	}
+
+	if s.serveFile(req, resp, name) {
+		return
+	}
+	if s.SPA && len(s.Index) != 0 && s.serveFile(req, resp, s.Index[0]) {
+		return
+	}
+
+	resp.StatusCode(http.StatusNotFound)
+}
+
+// serveFile serve file or index file of directory, return false if not found
+func (s *Static) serveFile(req zerver.Request, resp zerver.Response, name string) bool {
+	file, info := s.open(name)
+	if file == nil {
+		return false
+	}
+
+	if info.IsDir() {
+		file.Close()
+		if p := req.URL().Path; !strings.HasSuffix(p, "/") {
+			redirectDir(req, resp)
+			return true
+		}
+		for _, index := range s.Index {
+			if file, info = s.open(path.Join(name, index)); file != nil {
+				if !info.IsDir() {
+					name = path.Join(name, index)
+					break
+				}
+				file.Close()
+				file = nil
+			}
+		}
+		if file == nil {
+			return false
+		}
+	}
+	defer file.Close()
+
+	headers := resp.Headers()
+	if s.Gzip {
+		zerver.AddVary(headers, zerver.HEADER_ACCEPTENCODING)
+		if zerver.AcceptEncoding(req.GetHeader(zerver.HEADER_ACCEPTENCODING), zerver.ENCODING_GZIP) != "" {
+			if gzFile, gzInfo := s.open(name + ".gz"); gzFile != nil {
+				if !gzInfo.IsDir() {
+					file.Close()
+					file, info = gzFile, gzInfo
+					headers.Set(zerver.HEADER_CONTENTENCODING, zerver.ENCODING_GZIP)
+				} else {
+					gzFile.Close()
+				}
+			}
+		}
+	}
+
+	// strong ETag, so If-Range works, each representation has its own
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	if headers.Get(zerver.HEADER_CONTENTENCODING) != "" {
+		etag = etag[:len(etag)-1] + `-gz"`
+	}
+	headers.Set("ETag", etag)
+	if s.cacheControl != "" {
+		headers.Set(zerver.HEADER_CACHECONTROL, s.cacheControl)
+	}
+
+	content, err := readSeeker(file)
+	if err != nil {
+		resp.StatusCode(http.StatusInternalServerError)
+		return true
+	}
+	// name decides the content type, the .gz suffix is not included
+	http.ServeContent(responseWriter{resp}, req.HTTPRequest(), path.Base(name), info.ModTime(), content)
+
+	return true
+}
+
+// redirectDir redirect to the directory path with trailing slash, the target
+// is relative so it works under any mount path
+func redirectDir(req zerver.Request, resp zerver.Response) {
+	u := req.URL()
+	target := path.Base(u.Path) + "/"
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	resp.Headers().Set("Location", target)
+	resp.StatusCode(http.StatusMovedPermanently)
+}
+
+func (s *Static) open(name string) (fs.File, fs.FileInfo) {
+	if name == "" {
+		name = "."
+	}
+	file, err := s.FS.Open(name)
+	if err != nil {
+		return nil, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil
+	}
+
+	return file, info
+}
+
+// cleanPath convert url path to a fs.FS path, paths try to escape from root
+// are rejected
+func cleanPath(p string) (string, bool) {
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", false
+	}
+	for _, section := range strings.Split(p, "/") {
+		if section == ".." {
+			return "", false
+		}
+	}
+
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return ".", true
+	}
+
+	return p, fs.ValidPath(p)
+}
+
+func readSeeker(file fs.File) (io.ReadSeeker, error) {
+	if rs, is := file.(io.ReadSeeker); is {
+		return rs, nil
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(file)
+	return bytes.NewReader(buf.Bytes()), err
+}
+
+// responseWriter adapt zerver.Response to http.ResponseWriter, status code
+// is managed by zerver.Response
+type responseWriter struct {
+	zerver.Response
+}
+
+func (w responseWriter) Header() http.Header {
+	return w.Headers()
+}
+
+func (w responseWriter) WriteHeader(status int) {
+	w.StatusCode(status)
+}
@@ -0,0 +1,99 @@
+package zerver
+
+import (
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const (
+	// ATTR_CORRELATIONID is the request attribute of correlation id
+	ATTR_CORRELATIONID = "CorrelationID"
+	// LOG_CORRELATIONID is the log field of correlation id
+	LOG_CORRELATIONID = "correlationId"
+)
+
+// RequestLogger add request fields such as correlation id to every entry, it's
+// shared by request and response, and only valid during request. Loggers
+// returned by For share fields with it, include fields set later, so all
+// loggers used in request through For get the correlation id. The id isn't
+// propagated to loggers used directly, such as those created by log.Derive.
+type RequestLogger struct {
+	*log.Logger
+	fields log.M
+	root   *RequestLogger // owner of fields, nil for itself
+}
+
+// NewRequestLogger create a logger add fields to every entry of logger
+func NewRequestLogger(logger *log.Logger, fields log.M) *RequestLogger {
+	return &RequestLogger{Logger: logger, fields: fields}
+}
+
+func (l *RequestLogger) reset(logger *log.Logger) {
+	l.Logger = logger
+	l.fields = nil
+	l.root = nil
+}
+
+func (l *RequestLogger) owner() *RequestLogger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// Set add a field to all entries after, of this logger and loggers share
+// fields with it
+func (l *RequestLogger) Set(name string, value interface{}) {
+	o := l.owner()
+	if o.fields == nil {
+		o.fields = make(log.M)
+	}
+	o.fields[name] = value
+}
+
+func (l *RequestLogger) Fields() log.M {
+	return l.owner().fields
+}
+
+// For return a logger add same fields to entries of another logger, it's
+// used by filters and handlers which have their own logger
+//
+//	h.log.Warn(...) => req.Log().For(h.log).Warn(...)
+func (l *RequestLogger) For(logger *log.Logger) *RequestLogger {
+	return &RequestLogger{Logger: logger, root: l.owner()}
+}
+
+func (l *RequestLogger) merge(m log.M) log.M {
+	fields := l.Fields()
+	if len(fields) == 0 {
+		return m
+	}
+	if m == nil {
+		m = make(log.M, len(fields))
+	}
+	for k, v := range fields {
+		if _, has := m[k]; !has {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func (l *RequestLogger) Debug(m log.M) {
+	l.Logger.Debug(l.merge(m))
+}
+
+func (l *RequestLogger) Info(m log.M) {
+	l.Logger.Info(l.merge(m))
+}
+
+func (l *RequestLogger) Warn(m log.M) {
+	l.Logger.Warn(l.merge(m))
+}
+
+func (l *RequestLogger) Error(m log.M) {
+	l.Logger.Error(l.merge(m))
+}
+
+func (l *RequestLogger) Fatal(m log.M) {
+	l.Logger.Fatal(l.merge(m))
+}
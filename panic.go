@@ -0,0 +1,66 @@
+package zerver
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const (
+	// sources of panic
+	PANIC_HTTP      = "http"
+	PANIC_WEBSOCKET = "websocket"
+	PANIC_TASK      = "task"
+)
+
+// Panic is a recovered panic
+type Panic struct {
+	Source        string
+	Pattern       string
+	CorrelationID string
+	Value         interface{}
+	Stack         []byte
+	Request       Request // only for PANIC_HTTP
+}
+
+// NewPanic create a Panic with current stack, it should be called in the
+// deferred function which recovered
+func NewPanic(source, pattern string, v interface{}) *Panic {
+	return &Panic{
+		Source:  source,
+		Pattern: pattern,
+		Value:   v,
+		Stack:   debug.Stack(),
+	}
+}
+
+// String return the value and stack, so it's still complete if it's panicked
+// again
+func (p *Panic) String() string {
+	return fmt.Sprintf("%v\n%s", p.Value, p.Stack)
+}
+
+// HandlePanic log the panic and pass it to ServerOption.OnPanic
+func (s *Server) HandlePanic(p *Panic) {
+	m := log.M{
+		"msg":     "panic recovered",
+		"source":  p.Source,
+		"pattern": p.Pattern,
+		"panic":   p.Value,
+		"stack":   string(p.Stack),
+	}
+	if p.CorrelationID != "" {
+		m[LOG_CORRELATIONID] = p.CorrelationID
+	}
+	s.log.Error(m)
+
+	if s.onPanic != nil {
+		defer func() {
+			if e := recover(); e != nil {
+				s.log.Error(log.M{"msg": "panic in panic handler", "panic": e})
+			}
+		}()
+		s.onPanic(p)
+	}
+}
@@ -7,14 +7,16 @@ import (
 )
 
 type requestEnv struct {
-	req  request
-	resp response
+	req    request
+	resp   response
+	logger RequestLogger
 }
 
 var reqEnvPool = &sync.Pool{
 	New: func() interface{} {
 		env := &requestEnv{}
 		env.req.Attrs = attrs.New()
+		env.req.reqEnv = env
 		return env
 	},
 }
@@ -1,12 +1,37 @@
 package zerver
 
-import "net/url"
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cosiner/gohper/errors"
+)
+
+const (
+	ErrBodyConsumed = errors.Err("request body already consumed")
+)
+
+// body state of request, form parsing and Request.Read/Receive both consume
+// the body, only one of them can succeed
+const (
+	_BODY_UNREAD = iota
+	_BODY_READ
+	_BODY_FORM
+)
 
 type ReqVars struct {
-	urlVars   map[string]int
-	urlVals   []string
-	queryVars url.Values
-	formVars  url.Values
+	urlVars map[string]int
+	urlVals []string
+
+	request     *http.Request
+	bodyState   int
+	queryParsed bool
+	queryVars   url.Values
+	queryErr    error
+	formParsed  bool
+	formVars    url.Values
+	formErr     error
 }
 
 // URLVar return values of variable
@@ -21,7 +46,65 @@ func (v *ReqVars) URLVar(name string) string {
 	return v.urlVals[i]
 }
 
+// ParseQuery parse url query if it's not parsed, it's called automaticlly
+// on first access of query variables, call it to check parse error
+func (v *ReqVars) ParseQuery() error {
+	if !v.queryParsed && v.request != nil {
+		v.queryParsed = true
+		v.queryVars, v.queryErr = url.ParseQuery(v.request.URL.RawQuery)
+	}
+	return v.queryErr
+}
+
+// ParseForm parse request body as form if it's not parsed, it's called
+// automaticlly on first access of form variables, call it to check parse error.
+//
+// A urlencoded body is consumed by form parsing, so ParseForm after
+// Request.Receive/Read, or Request.Receive/Read after ParseForm will return
+// ErrBodyConsumed.
+func (v *ReqVars) ParseForm() error {
+	if v.formParsed || v.request == nil {
+		return v.formErr
+	}
+	v.formParsed = true
+
+	requ := v.request
+	if requ.PostForm != nil { // already parsed by others, such as ParseMultipartForm
+		v.formVars = requ.PostForm
+		return nil
+	}
+	if !hasFormBody(requ) {
+		return nil
+	}
+	if v.bodyState == _BODY_READ {
+		v.formErr = ErrBodyConsumed
+		return v.formErr
+	}
+
+	v.bodyState = _BODY_FORM
+	v.formErr = requ.ParseForm()
+	v.formVars = requ.PostForm
+	return v.formErr
+}
+
+// readBody mark body will be read by Request.Read, if it's already consumed
+// by form parsing, ErrBodyConsumed was returned
+func (v *ReqVars) readBody() error {
+	if v.bodyState == _BODY_FORM {
+		return ErrBodyConsumed
+	}
+	v.bodyState = _BODY_READ
+	return nil
+}
+
+// setRequest update the underlay request, it should be called after request
+// was wrapped, variables already parsed will be reserved
+func (v *ReqVars) setRequest(requ *http.Request) {
+	v.request = requ
+}
+
 func (v *ReqVars) QueryVar(name string) string {
+	v.ParseQuery()
 	if v.queryVars == nil {
 		return ""
 	}
@@ -29,6 +112,7 @@ func (v *ReqVars) QueryVar(name string) string {
 }
 
 func (v *ReqVars) QueryVarMul(name string) []string {
+	v.ParseQuery()
 	if v.queryVars == nil {
 		return nil
 	}
@@ -36,6 +120,7 @@ func (v *ReqVars) QueryVarMul(name string) []string {
 }
 
 func (v *ReqVars) FormVar(name string) string {
+	v.ParseForm()
 	if v.formVars == nil {
 		return ""
 	}
@@ -43,8 +128,24 @@ func (v *ReqVars) FormVar(name string) string {
 }
 
 func (v *ReqVars) FormVarMul(name string) []string {
+	v.ParseForm()
 	if v.formVars == nil {
 		return nil
 	}
 	return v.formVars[name]
 }
+
+// hasFormBody check whether the request body will be read by http.Request.ParseForm
+func hasFormBody(requ *http.Request) bool {
+	switch requ.Method {
+	case METHOD_POST, METHOD_PUT, METHOD_PATCH:
+	default:
+		return false
+	}
+
+	ct := requ.Header.Get(HEADER_CONTENTTYPE)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.TrimSpace(strings.ToLower(ct)) == CONTENTTYPE_FORM
+}
@@ -1,12 +1,14 @@
 package zerver
 
 import (
+	"context"
 	"encoding/base64"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
 
+	"github.com/cosiner/gohper/encoding"
 	"github.com/cosiner/gohper/errors"
 	"github.com/cosiner/gohper/utils/attrs"
 )
@@ -23,13 +25,28 @@ type (
 
 	Request interface {
 		Wrap(RequestWrapper)
+		// HTTPRequest return the underlying request for reading, it must not be
+		// modified or kept after request, use Wrap to replace it
+		HTTPRequest() *http.Request
 		patternKeeper
 
 		ReqMethod() string
 		URL() *url.URL
 		GetHeader(name string) string
 		RemoteAddr() string
+		// ClientIP return canonical client ip, forwarding headers are only
+		// trusted if request is from ServerOption.TrustedProxies
+		ClientIP() string
 		Authorization() (string, bool)
+		Cookie(name string) (*http.Cookie, error)
+		// Context is canceled when client connection closed
+		Context() context.Context
+		// Session return session of request, nil if session filter is not used
+		Session() Session
+		// CorrelationID return the correlation id set by correlation filter
+		CorrelationID() string
+		// Log return the logger add request fields to every entry
+		Log() *RequestLogger
 
 		Vars() *ReqVars
 		attrs.Attrs
@@ -37,6 +54,11 @@ type (
 		io.Reader
 
 		Receive(interface{}) error
+		// Detach keep request and response from being recycled after filter
+		// chain returned, it's for handler still running in another goroutine,
+		// release must be called once it's finished. The response is still
+		// finished when filter chain returned.
+		Detach() (release func())
 		destroy()
 	}
 
@@ -48,7 +70,11 @@ type (
 		*http.Request
 
 		vars      *ReqVars
+		clientIP  string
+		log       *RequestLogger
 		needClose bool
+		detached  bool
+		reqEnv    *requestEnv // nil if not managed by server
 	}
 )
 
@@ -62,9 +88,7 @@ func (req *request) init(e Env, requ *http.Request, pattern string, reqVars *Req
 	req.Env = e
 	req.Request = requ
 
-	requ.ParseForm()
-	reqVars.queryVars = requ.Form
-	reqVars.formVars = requ.PostForm
+	reqVars.setRequest(requ) // query and form will be parsed on first access
 	req.vars = reqVars
 
 	method := requ.Method
@@ -81,6 +105,9 @@ func (req *request) destroy() {
 	req.Attrs.Clear()
 	req.Env = nil
 	req.vars = nil
+	req.clientIP = ""
+	req.log = nil
+	req.detached = false
 
 	if req.needClose {
 		req.needClose = false
@@ -89,10 +116,29 @@ func (req *request) destroy() {
 	req.Request = nil
 }
 
+func (req *request) Detach() func() {
+	reqEnv := req.reqEnv
+	if reqEnv == nil {
+		return func() {}
+	}
+
+	req.detached = true
+	return func() {
+		reqEnv.req.destroy()
+		recycleRequestEnv(reqEnv)
+	}
+}
+
 func (req *request) Wrap(fn RequestWrapper) {
 	req.Request, req.needClose = fn(req.Request, req.needClose)
 	req.Method = MethodName(req.Method)
+	req.vars.setRequest(req.Request)
 }
+
+func (req *request) HTTPRequest() *http.Request {
+	return req.Request
+}
+
 func (req *request) ReqMethod() string {
 	return req.Method
 }
@@ -111,6 +157,27 @@ func (req *request) RemoteAddr() string {
 	return req.Request.RemoteAddr
 }
 
+func (req *request) ClientIP() string {
+	if req.clientIP == "" {
+		req.clientIP = req.Server().ClientIP(req.Request)
+	}
+	return req.clientIP
+}
+
+func (req *request) CorrelationID() string {
+	id, _ := req.Attr(ATTR_CORRELATIONID).(string)
+	return id
+}
+
+func (req *request) Log() *RequestLogger {
+	return req.log
+}
+
+// StartTask start a task carry the correlation id of request
+func (req *request) StartTask(path string, value interface{}) {
+	req.Server().startTask(path, value, req.CorrelationID())
+}
+
 func (req *request) Vars() *ReqVars {
 	return req.vars
 }
@@ -130,9 +197,22 @@ func (req *request) Authorization() (string, bool) {
 }
 
 func (req *request) Read(data []byte) (int, error) {
+	if err := req.vars.readBody(); err != nil {
+		return 0, err
+	}
 	return req.Body.Read(data)
 }
 
+// Receive decode request body with codec selected by Content-Type, if it's
+// empty, the default codec is used, if there is no codec for it,
+// ErrUnsupportedMediaType is returned
 func (req *request) Receive(v interface{}) error {
-	return req.Codec().Decode(req, v)
+	codecs := req.Codecs()
+	var codec encoding.Codec
+	if ct := req.GetHeader(HEADER_CONTENTTYPE); ct == "" {
+		_, codec = codecs.Default()
+	} else if codec = codecs.Get(ct); codec == nil {
+		return ErrUnsupportedMediaType
+	}
+	return codec.Decode(req, v)
 }
@@ -28,9 +28,15 @@ type (
 		Wrap(ResponseWrapper)
 		Headers() http.Header
 		StatusCode(statusCode int) int
+		// Committed report whether status and headers are already written
+		Committed() bool
 		Value() interface{}
 		SetValue(interface{})
 		Send(interface{}) error
+		SetCookie(*http.Cookie)
+		DelCookie(name string)
+		// Log return the logger add request fields to every entry
+		Log() *RequestLogger
 
 		destroy()
 	}
@@ -43,24 +49,44 @@ type (
 		statusWrited bool
 		value        interface{}
 		needClose    bool
+		accept       string // request Accept header for content negotiation
+		defaultType  string // Content-Type from ServerOption.Headers, it's not a choice of handler
+		log          *RequestLogger
 
 		hijacked bool
 	}
 )
 
 // newResponse create a new response, and set default content type to HTML
-func (resp *response) init(env Env, w http.ResponseWriter) Response {
+func (resp *response) init(env Env, w http.ResponseWriter, accept string) Response {
 	resp.Env = env
 	resp.ResponseWriter = w
 	resp.status = http.StatusOK
+	resp.accept = accept
 
 	return resp
 }
 
+// NewResponse create a standalone response not managed by server, it's used
+// to run handlers on another writer such as a buffer, accept is the request
+// Accept header for content negotiation
+func NewResponse(env Env, w http.ResponseWriter, accept string) Response {
+	resp := new(response)
+	if r, is := env.(Response); is {
+		resp.log = r.Log()
+	} else {
+		resp.log = NewRequestLogger(env.Logger(), nil)
+	}
+	return resp.init(env, w, accept)
+}
+
 func (resp *response) destroy() {
 	resp.flushHeader()
 	resp.statusWrited = false
 	resp.value = nil
+	resp.accept = ""
+	resp.defaultType = ""
+	resp.log = nil
 
 	if resp.needClose && !resp.hijacked {
 		resp.needClose = false
@@ -88,6 +114,10 @@ func (resp *response) StatusCode(statusCode int) int {
 	return resp.status
 }
 
+func (resp *response) Committed() bool {
+	return resp.statusWrited || resp.hijacked
+}
+
 func (resp *response) Status() int {
 	return resp.status
 }
@@ -114,6 +144,10 @@ func (resp *response) Headers() http.Header {
 	return resp.ResponseWriter.Header()
 }
 
+func (resp *response) Log() *RequestLogger {
+	return resp.log
+}
+
 func (resp *response) Value() interface{} {
 	return resp.value
 }
@@ -127,6 +161,70 @@ func (resp *response) Write(data []byte) (i int, err error) {
 	return resp.ResponseWriter.Write(data)
 }
 
+// Send encode value with codec selected by Content-Type if it's already set by
+// handler or filters, otherwise by the Accept header of request among codecs
+// can encode the value, and set the Content-Type. Content-Type set by
+// ServerOption.Headers doesn't disable negotiation.
+// If there is no acceptable codec, status 406 is set and ErrNotAcceptable is returned.
 func (resp *response) Send(v interface{}) error {
-	return resp.Codec().Encode(resp, v)
+	codecs := resp.Codecs()
+	headers := resp.Headers()
+	if ct := headers.Get(HEADER_CONTENTTYPE); ct != "" && ct != resp.defaultType {
+		if codec := codecs.Get(ct); codec != nil {
+			return codec.Encode(resp, v)
+		}
+	}
+
+	typ, codec := codecs.Negotiate(resp.accept, v)
+	if codec == nil {
+		resp.StatusCode(http.StatusNotAcceptable)
+		return ErrNotAcceptable
+	}
+	if isTextMediaType(typ) {
+		typ += "; charset=utf-8"
+	}
+	headers.Set(HEADER_CONTENTTYPE, typ)
+	return codec.Encode(resp, v)
+}
+
+// NewCookie create a cookie with secure defaults: path "/", HttpOnly, Secure
+// and SameSite=Lax
+func NewCookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// SetCookie add a Set-Cookie header of a copy of c, path "/" and SameSite=Lax
+// are used if they are not set, HttpOnly and Secure are kept as is, create
+// cookie by NewCookie to get them. If ServerOption.InsecureCookies is set,
+// Secure is cleared.
+func (resp *response) SetCookie(c *http.Cookie) {
+	cookie := *c
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if cookie.SameSite == 0 {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	if resp.Env != nil && resp.Server().insecureCookies {
+		cookie.Secure = false
+	}
+	if v := cookie.String(); v != "" {
+		resp.Headers().Add(HEADER_SETCOOKIE, v)
+	}
+}
+
+// DelCookie tell client to delete the cookie under path "/"
+func (resp *response) DelCookie(name string) {
+	resp.SetCookie(&http.Cookie{
+		Name:   name,
+		Path:   "/",
+		MaxAge: -1,
+	})
 }
@@ -53,9 +53,23 @@ type (
 		// if not nil, cert and key will be ignored
 		TLSConfig *tls.Config
 
+		// trusted proxies CIDRs or IPs, forwarding headers from them are used to
+		// get client ip, default none
+		TrustedProxies []string
+
 		Headers map[string]string
-		Codec   encoding.Codec
-		Logger  *log.Logger
+		// InsecureCookies clear Secure of cookies added by Response.SetCookie,
+		// for development over http only
+		InsecureCookies bool
+		// default codec for application/json, default encoding.JSON
+		Codec encoding.Codec
+		// codecs for content negotiation, default NewCodecs(Codec)
+		Codecs *Codecs
+		Logger *log.Logger
+		// OnPanic is called with recovered panics of filter.Recovery, websocket
+		// handlers and task handlers such as msq.Queue, it's used to report to
+		// error tracker, panics are always logged
+		OnPanic func(*Panic)
 	}
 
 	// Server represent a web server
@@ -75,6 +89,11 @@ type (
 
 		headers map[string]string
 		codec   encoding.Codec
+		codecs  *Codecs
+		proxies TrustedProxies
+		onPanic func(*Panic)
+
+		insecureCookies bool
 
 		log *log.Logger
 	}
@@ -123,6 +142,15 @@ func (s *Server) Codec() encoding.Codec {
 	return s.codec
 }
 
+func (s *Server) Codecs() *Codecs {
+	return s.codecs
+}
+
+// ClientIP return client ip of request, see TrustedProxies.ClientIP
+func (s *Server) ClientIP(request *http.Request) string {
+	return s.proxies.ClientIP(request)
+}
+
 func (s *Server) Logger() *log.Logger {
 	return s.log
 }
@@ -148,13 +176,21 @@ func (s *Server) RemoveComponent(name string) {
 
 // StartTask start a task synchronously, the value will be passed to task handler
 func (s *Server) StartTask(path string, value interface{}) {
+	s.startTask(path, value, "")
+}
+
+func (s *Server) startTask(path string, value interface{}, correlationID string) {
 	handler, pat := s.MatchTaskHandler(&url.URL{Path: path})
 	if handler == nil {
-		s.log.Warn(log.M{"msg": "task handler not found", "pattern": path})
+		m := log.M{"msg": "task handler not found", "pattern": path}
+		if correlationID != "" {
+			m[LOG_CORRELATIONID] = correlationID
+		}
+		s.log.Warn(m)
 		return
 	}
 
-	handler.Handle(newTask(pat, value))
+	handler.Handle(newTask(pat, value, correlationID))
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, request *http.Request) {
@@ -177,7 +213,14 @@ func (s *Server) serveWebSocket(w http.ResponseWriter, request *http.Request) {
 	} else {
 		conn, err := ws.UpgradeWebsocket(w, request, s.checker)
 		if err == nil {
-			handler.Handle(newWsConn(s, conn, pat, &vars))
+			wsConn := newWsConn(s, conn, pat, &vars)
+			defer func() {
+				if v := recover(); v != nil {
+					s.HandlePanic(NewPanic(PANIC_WEBSOCKET, pat, v))
+					wsConn.Close()
+				}
+			}()
+			handler.Handle(wsConn)
 		} // else connecion will be auto-closed when error occoured,
 	}
 }
@@ -189,12 +232,16 @@ func (s *Server) serveHTTP(w http.ResponseWriter, request *http.Request) {
 
 	reqEnv := newRequestEnv()
 	req := reqEnv.req.init(s, request, pat, &vars)
-	resp := reqEnv.resp.init(s, w)
+	resp := reqEnv.resp.init(s, w, request.Header.Get(HEADER_ACCEPT))
+	reqEnv.logger.reset(s.log)
+	reqEnv.req.log = &reqEnv.logger
+	reqEnv.resp.log = &reqEnv.logger
 
 	headers := resp.Headers()
 	for k, v := range s.headers {
 		headers.Set(k, v)
 	}
+	reqEnv.resp.defaultType = headers.Get(HEADER_CONTENTTYPE)
 
 	var chain FilterChain
 	if handler == nil {
@@ -205,6 +252,10 @@ func (s *Server) serveHTTP(w http.ResponseWriter, request *http.Request) {
 
 	newFilterChain(chain, filters...)(req, resp)
 
+	if reqEnv.req.detached { // recycled by release of Detach
+		resp.destroy()
+		return
+	}
 	req.destroy()
 	resp.destroy()
 	recycleRequestEnv(reqEnv)
@@ -222,6 +273,9 @@ func (o *ServerOption) init() {
 	if o.Codec == nil {
 		o.Codec = encoding.JSON
 	}
+	if o.Codecs == nil {
+		o.Codecs = NewCodecs(o.Codec)
+	}
 }
 
 func (o *ServerOption) TLSEnabled() bool {
@@ -240,10 +294,17 @@ func (s *Server) config(o *ServerOption) {
 		}
 	)
 	s.log = o.Logger
-	s.codec = o.Codec
+	s.codecs = o.Codecs
+	_, s.codec = o.Codecs.Default()
 	s.headers = o.Headers
+	s.onPanic = o.OnPanic
+	s.insecureCookies = o.InsecureCookies
 	s.checker = ws.HeaderChecker(o.WebSocketChecker).HandshakeCheck
 
+	var err error
+	s.proxies, err = ParseTrustedProxies(o.TrustedProxies...)
+	logErr(err)
+
 	logErr(s.components.Init(s))
 
 	s.log.Info(log.M{"msg": "Execute registered init before routes funcs "})
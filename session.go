@@ -0,0 +1,34 @@
+package zerver
+
+const (
+	// ATTR_SESSION is the request attribute of session, it's set by session filter
+	ATTR_SESSION = "Session"
+)
+
+// Session is the session of request, values must be gob encodable, custom
+// types should be registered by gob.Register
+type Session interface {
+	ID() string
+	Get(name string) interface{}
+	// Set store a value, it's encoded by encoding/gob, so custom types must be
+	// registered by gob.Register
+	Set(name string, value interface{})
+	Delete(name string)
+
+	// Flash add a value only available until it's read by Flashes
+	Flash(name string, value interface{})
+	// Flashes return and remove flash values
+	Flashes(name string) []interface{}
+
+	// Regenerate change session id and keep values, it should be called
+	// after login or privilege changed to prevent session fixation
+	Regenerate()
+	// Invalidate clear all values and remove session from store and client
+	Invalidate()
+}
+
+// Session return session of request, nil if session filter is not used
+func (req *request) Session() Session {
+	s, _ := req.Attr(ATTR_SESSION).(Session)
+	return s
+}
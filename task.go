@@ -4,6 +4,8 @@ type (
 	Task interface {
 		patternKeeper
 		Value() interface{}
+		// CorrelationID return correlation id of the request started the task
+		CorrelationID() string
 	}
 
 	TaskHandlerFunc func(Task)
@@ -15,14 +17,16 @@ type (
 
 	task struct {
 		patternString
-		value interface{}
+		value         interface{}
+		correlationID string
 	}
 )
 
-func newTask(pattern string, value interface{}) Task {
+func newTask(pattern string, value interface{}, correlationID string) Task {
 	return task{
 		patternString: patternString(pattern),
 		value:         value,
+		correlationID: correlationID,
 	}
 }
 
@@ -30,6 +34,10 @@ func (t task) Value() interface{} {
 	return t.value
 }
 
+func (t task) CorrelationID() string {
+	return t.correlationID
+}
+
 func convertTaskHandler(i interface{}) TaskHandler {
 	switch t := i.(type) {
 	case func(Task):
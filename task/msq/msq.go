@@ -19,11 +19,12 @@ type Queue struct {
 	TaskBufsize uint
 	Processor
 	EnableTypeChecking bool
-	NoRecover          bool
+	NoRecover          bool // don't recover Processor panics, otherwise pass them to Server.HandlePanic
 	BytesPool          bytes2.Pool
 
 	queue     chan zerver.Task
 	closeFlag sync2.Flag
+	server    *zerver.Server
 	log       *log.Logger
 }
 
@@ -39,6 +40,7 @@ func (m *Queue) Init(env zerver.Env) error {
 	}
 
 	m.queue = make(chan zerver.Task, m.TaskBufsize)
+	m.server = env.Server()
 	m.log = log.Derive("TaskHandler", "MessageQueue")
 	go m.start()
 	return nil
@@ -56,9 +58,24 @@ func (m *Queue) Handle(msg zerver.Task) {
 }
 
 func (m *Queue) process(msg zerver.Task) {
+	if !m.NoRecover {
+		defer func() {
+			if v := recover(); v != nil {
+				p := zerver.NewPanic(zerver.PANIC_TASK, msg.Pattern(), v)
+				p.CorrelationID = msg.CorrelationID()
+				m.server.HandlePanic(p)
+			}
+		}()
+	}
+
 	err := m.Process(msg.Value())
 	if err != nil {
-		m.log.Error(log.M{"msg": "process message failed", "err": err.Error(), "pattern": msg.Pattern()})
+		m.log.Error(log.M{
+			"msg":                    "process message failed",
+			"err":                    err.Error(),
+			"pattern":                msg.Pattern(),
+			zerver.LOG_CORRELATIONID: msg.CorrelationID(),
+		})
 	}
 }
 
@@ -0,0 +1,292 @@
+package zerver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sources of request variables
+	VAR_URL   = "path"
+	VAR_QUERY = "query"
+	VAR_FORM  = "form"
+)
+
+type (
+	// TypedVars convert variables to typed values, default value is returned if
+	// variable is absent, if conversion failed, default value and a FieldErrors
+	// contains the only failure is returned
+	TypedVars struct {
+		source string
+		get    func(string) []string
+	}
+
+	// VarCollector is the collecting variant of TypedVars, conversion
+	// failures are recorded, call Err once after all variables are accessed
+	VarCollector struct {
+		vars *ReqVars
+		errs FieldErrors
+	}
+
+	// CollectedVars is the TypedVars of VarCollector, it only return values
+	CollectedVars struct {
+		vars TypedVars
+		c    *VarCollector
+	}
+)
+
+func (v *ReqVars) urlVarMul(name string) []string {
+	if val := v.URLVar(name); val != "" {
+		return []string{val}
+	}
+	return nil
+}
+
+func (v *ReqVars) URL() TypedVars {
+	return TypedVars{source: VAR_URL, get: v.urlVarMul}
+}
+
+func (v *ReqVars) Query() TypedVars {
+	return TypedVars{source: VAR_QUERY, get: v.QueryVarMul}
+}
+
+func (v *ReqVars) Form() TypedVars {
+	return TypedVars{source: VAR_FORM, get: v.FormVarMul}
+}
+
+func (t TypedVars) value(name string) string {
+	if vals := t.get(name); len(vals) != 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (t TypedVars) err(name, msg string) error {
+	return FieldErrors{{Field: name, Source: t.source, Error: msg}}
+}
+
+func (t TypedVars) String(name, def string) string {
+	if s := t.value(name); s != "" {
+		return s
+	}
+	return def
+}
+
+func (t TypedVars) Int(name string, def int) (int, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def, t.err(name, "must be an integer")
+	}
+	return n, nil
+}
+
+func (t TypedVars) Int64(name string, def int64) (int64, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return def, t.err(name, "must be an integer")
+	}
+	return n, nil
+}
+
+func (t TypedVars) Uint(name string, def uint) (uint, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 0)
+	if err != nil {
+		return def, t.err(name, "must be an unsigned integer")
+	}
+	return uint(n), nil
+}
+
+func (t TypedVars) Bool(name string, def bool) (bool, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return def, t.err(name, "must be a boolean")
+	}
+	return b, nil
+}
+
+func (t TypedVars) Float(name string, def float64) (float64, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return def, t.err(name, "must be a number")
+	}
+	return f, nil
+}
+
+// Time parse variable with layout, if layout is empty, time.RFC3339 is used
+func (t TypedVars) Time(name, layout string, def time.Time) (time.Time, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	tm, err := time.Parse(layout, s)
+	if err != nil {
+		return def, t.err(name, "must be a time in format "+layout)
+	}
+	return tm, nil
+}
+
+func (t TypedVars) Duration(name string, def time.Duration) (time.Duration, error) {
+	s := t.value(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return def, t.err(name, "must be a duration")
+	}
+	return d, nil
+}
+
+// Strings return all values of variable, each value is also splited by ','
+func (t TypedVars) Strings(name string, def []string) []string {
+	vals := t.get(name)
+	if len(vals) == 0 {
+		return def
+	}
+
+	var res []string
+	for _, val := range vals {
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	if len(res) == 0 {
+		return def
+	}
+	return res
+}
+
+func (t TypedVars) Ints(name string, def []int) ([]int, error) {
+	vals := t.Strings(name, nil)
+	if vals == nil {
+		return def, nil
+	}
+
+	res := make([]int, len(vals))
+	for i, s := range vals {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return def, t.err(name, "must be a list of integer")
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+// Collect create a VarCollector for request variables
+//
+//	c := req.Vars().Collect()
+//	id := c.URL().Int64("id", 0)
+//	page := c.Query().Int("page", 1)
+//	if err := c.Err(); err != nil {
+//	    handle.SendErr(resp, err)
+//	    return
+//	}
+func (v *ReqVars) Collect() *VarCollector {
+	return &VarCollector{vars: v}
+}
+
+func (c *VarCollector) URL() CollectedVars {
+	return CollectedVars{vars: c.vars.URL(), c: c}
+}
+
+func (c *VarCollector) Query() CollectedVars {
+	return CollectedVars{vars: c.vars.Query(), c: c}
+}
+
+func (c *VarCollector) Form() CollectedVars {
+	return CollectedVars{vars: c.vars.Form(), c: c}
+}
+
+// Err return nil if there is no failures, otherwise a FieldErrors
+func (c *VarCollector) Err() error {
+	return c.errs.Err()
+}
+
+func (c *VarCollector) record(err error) {
+	if err != nil {
+		c.errs = append(c.errs, err.(FieldErrors)...)
+	}
+}
+
+func (c CollectedVars) String(name, def string) string {
+	return c.vars.String(name, def)
+}
+
+func (c CollectedVars) Int(name string, def int) int {
+	n, err := c.vars.Int(name, def)
+	c.c.record(err)
+	return n
+}
+
+func (c CollectedVars) Int64(name string, def int64) int64 {
+	n, err := c.vars.Int64(name, def)
+	c.c.record(err)
+	return n
+}
+
+func (c CollectedVars) Uint(name string, def uint) uint {
+	n, err := c.vars.Uint(name, def)
+	c.c.record(err)
+	return n
+}
+
+func (c CollectedVars) Bool(name string, def bool) bool {
+	b, err := c.vars.Bool(name, def)
+	c.c.record(err)
+	return b
+}
+
+func (c CollectedVars) Float(name string, def float64) float64 {
+	f, err := c.vars.Float(name, def)
+	c.c.record(err)
+	return f
+}
+
+func (c CollectedVars) Time(name, layout string, def time.Time) time.Time {
+	t, err := c.vars.Time(name, layout, def)
+	c.c.record(err)
+	return t
+}
+
+func (c CollectedVars) Duration(name string, def time.Duration) time.Duration {
+	d, err := c.vars.Duration(name, def)
+	c.c.record(err)
+	return d
+}
+
+func (c CollectedVars) Strings(name string, def []string) []string {
+	return c.vars.Strings(name, def)
+}
+
+func (c CollectedVars) Ints(name string, def []int) []int {
+	n, err := c.vars.Ints(name, def)
+	c.c.record(err)
+	return n
+}
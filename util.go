@@ -1,6 +1,9 @@
 package zerver
 
-import "strings"
+import (
+	"net/http"
+	"strings"
+)
 
 const (
 	// Http Header
@@ -13,11 +16,15 @@ const (
 	HEADER_ACCEPT          = "Accept"
 	HEADER_ACCEPTENCODING  = "Accept-Encoding"
 	HEADER_CACHECONTROL    = "Cache-Control"
+	HEADER_VARY            = "Vary"
 	HEADER_EXPIRES         = "Expires"
 	HEADER_AUTHRIZATION    = "Authorization"
 	HEADER_METHODOVERRIDE  = "X-HTTP-Method-Override"
 	HEADER_REALIP          = "X-Real-IP"
 
+	// ContentType
+	CONTENTTYPE_FORM = "application/x-www-form-urlencoded"
+
 	// ContentEncoding
 	ENCODING_GZIP    = "gzip"
 	ENCODING_DEFLATE = "deflate"
@@ -32,6 +39,18 @@ const (
 	METHOD_OPTIONS = "OPTIONS"
 )
 
+// AddVary add value to Vary header if it's not already listed
+func AddVary(headers http.Header, value string) {
+	for _, v := range headers[HEADER_VARY] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "*" || strings.EqualFold(s, value) {
+				return
+			}
+		}
+	}
+	headers.Add(HEADER_VARY, value)
+}
+
 func MethodName(s string) string {
 	if s == "" {
 		return METHOD_GET
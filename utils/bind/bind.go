@@ -0,0 +1,484 @@
+// Package bind fill structure fields from request path variables, query, form,
+// headers and body, then validate them by declarative tags.
+//
+//	type Query struct {
+//	    ID    int      `path:"id"`
+//	    Page  int      `query:"page" validate:"min=1,max=100"`
+//	    Token string   `header:"X-Token" validate:"required"`
+//	    Name  string   `form:"name" validate:"required,regex=^[a-z]+$"`
+//	    Sort  string   `query:"sort" validate:"enum=asc|desc"`
+//	    Tags  []string `query:"tag"`
+//	}
+//
+// Validation rules are seperated by ',', regex must be the last rule for it
+// may contains ','.
+package bind
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	ErrNotStructPtr = errors.Err("bind destination must be a pointer to structure")
+
+	SOURCE_PATH   = "path"
+	SOURCE_QUERY  = "query"
+	SOURCE_FORM   = "form"
+	SOURCE_HEADER = "header"
+	SOURCE_BODY   = "body"
+)
+
+var sources = []string{SOURCE_PATH, SOURCE_QUERY, SOURCE_FORM, SOURCE_HEADER}
+
+type (
+	field struct {
+		index  []int
+		name   string
+		source string // empty for body fields
+		rules  []rule
+	}
+
+	rule struct {
+		name  string
+		arg   string
+		num   float64
+		regex *regexp.Regexp
+		enum  []string
+	}
+
+	structInfo struct {
+		fields  []field
+		hasForm bool
+	}
+)
+
+var (
+	cache   = make(map[reflect.Type]*structInfo)
+	cacheMu sync.RWMutex
+
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	unmarshalerTyp = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Bind decode request body by Request.Receive if request has a non-form body,
+// then fill v from path, query, form and headers, fields with source tag are
+// always from their sources, so body can't override them. At last validate it,
+// conversion and validation failures are returned together as zerver.FieldErrors.
+func Bind(req zerver.Request, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ErrNotStructPtr
+	}
+	rv = rv.Elem()
+
+	info, err := parseStruct(rv.Type())
+	if err != nil {
+		return err
+	}
+
+	var errs zerver.FieldErrors
+	if info.hasForm {
+		if err := req.Vars().ParseForm(); err != nil {
+			errs.Add(SOURCE_FORM, "", err.Error())
+			return errs
+		}
+	}
+
+	if hasBody(req) {
+		if err := req.Receive(v); err != nil && err != io.EOF {
+			if _, is := err.(interface {
+				Code() int
+			}); is {
+				return err
+			}
+			errs.Add(SOURCE_BODY, "", err.Error())
+		}
+	}
+
+	invalid := make(map[int]bool) // fields failed to convert, skip validation
+	for i := range info.fields {
+		f := &info.fields[i]
+		if f.source == "" {
+			continue
+		}
+
+		fv := rv.FieldByIndex(f.index)
+		fv.Set(reflect.Zero(fv.Type())) // drop value from body
+		vals := values(req, f.source, f.name)
+		if len(vals) == 0 {
+			continue
+		}
+		if err := setValue(fv, vals); err != nil {
+			errs.Add(f.source, f.name, err.Error())
+			invalid[i] = true
+		}
+	}
+
+	info.validate(rv, invalid, &errs)
+	return errs.Err()
+}
+
+// Validate check structure fields by validate tags
+func Validate(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return ErrNotStructPtr
+	}
+
+	info, err := parseStruct(rv.Type())
+	if err != nil {
+		return err
+	}
+
+	var errs zerver.FieldErrors
+	info.validate(rv, nil, &errs)
+	return errs.Err()
+}
+
+func (info *structInfo) validate(rv reflect.Value, skip map[int]bool, errs *zerver.FieldErrors) {
+	for i := range info.fields {
+		if skip[i] {
+			continue
+		}
+		f := &info.fields[i]
+		fv := rv.FieldByIndex(f.index)
+		for j := range f.rules {
+			if msg := f.rules[j].check(fv); msg != "" {
+				source := f.source
+				if source == "" {
+					source = SOURCE_BODY
+				}
+				errs.Add(source, f.name, msg)
+				break
+			}
+		}
+	}
+}
+
+func values(req zerver.Request, source, name string) []string {
+	vars := req.Vars()
+	switch source {
+	case SOURCE_PATH:
+		if val := vars.URLVar(name); val != "" {
+			return []string{val}
+		}
+	case SOURCE_QUERY:
+		return vars.QueryVarMul(name)
+	case SOURCE_FORM:
+		return vars.FormVarMul(name)
+	case SOURCE_HEADER:
+		if val := req.GetHeader(name); val != "" {
+			return []string{val}
+		}
+	}
+	return nil
+}
+
+func hasBody(req zerver.Request) bool {
+	switch req.ReqMethod() {
+	case zerver.METHOD_POST, zerver.METHOD_PUT, zerver.METHOD_PATCH:
+	default:
+		return false
+	}
+	if req.GetHeader(zerver.HEADER_CONTENTLENGTH) == "0" {
+		return false
+	}
+
+	ct := strings.ToLower(req.GetHeader(zerver.HEADER_CONTENTTYPE))
+	return !strings.HasPrefix(ct, zerver.CONTENTTYPE_FORM) &&
+		!strings.HasPrefix(ct, "multipart/")
+}
+
+func parseStruct(t reflect.Type) (*structInfo, error) {
+	cacheMu.RLock()
+	info := cache[t]
+	cacheMu.RUnlock()
+	if info != nil {
+		return info, nil
+	}
+
+	info = &structInfo{}
+	if err := info.parse(t, nil); err != nil {
+		return nil, err
+	}
+
+	cacheMu.Lock()
+	cache[t] = info
+	cacheMu.Unlock()
+	return info, nil
+}
+
+func (info *structInfo) parse(t reflect.Type, index []int) error {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		idx := append(append(make([]int, 0, len(index)+1), index...), i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if err := info.parse(sf.Type, idx); err != nil {
+				return err
+			}
+			continue
+		}
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+
+		f := field{index: idx}
+		for _, source := range sources {
+			if name := sf.Tag.Get(source); name != "" && name != "-" {
+				f.source, f.name = source, name
+				break
+			}
+		}
+		if f.source == SOURCE_FORM {
+			info.hasForm = true
+		}
+		if f.name == "" {
+			f.name = bodyName(sf)
+		}
+
+		rules, err := parseRules(sf.Tag.Get("validate"))
+		if err != nil {
+			return fmt.Errorf("bind: field %s: %s", sf.Name, err.Error())
+		}
+		f.rules = rules
+
+		if f.source != "" || len(f.rules) != 0 {
+			info.fields = append(info.fields, f)
+		}
+	}
+	return nil
+}
+
+func bodyName(sf reflect.StructField) string {
+	for _, tag := range []string{"json", "xml"} {
+		name := sf.Tag.Get(tag)
+		if i := strings.IndexByte(name, ','); i >= 0 {
+			name = name[:i]
+		}
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+func parseRules(tag string) ([]rule, error) {
+	var rules []rule
+	for tag != "" {
+		var r rule
+		var s string
+		if strings.HasPrefix(tag, "regex=") {
+			s, tag = tag, ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			s, tag = tag[:i], tag[i+1:]
+		} else {
+			s, tag = tag, ""
+		}
+
+		r.name = s
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			r.name, r.arg = s[:i], s[i+1:]
+		}
+
+		var err error
+		switch r.name {
+		case "required":
+		case "min", "max":
+			r.num, err = strconv.ParseFloat(r.arg, 64)
+		case "regex":
+			r.regex, err = regexp.Compile(r.arg)
+		case "enum":
+			r.enum = strings.Split(r.arg, "|")
+		default:
+			err = fmt.Errorf("unknown validate rule %s", r.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (r *rule) check(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			if r.name == "required" {
+				return "required"
+			}
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch r.name {
+	case "required":
+		if isZero(v) {
+			return "required"
+		}
+	case "min", "max":
+		n, ok := number(v)
+		if !ok {
+			return ""
+		}
+		if r.name == "min" && n < r.num {
+			return "must not be less than " + r.arg
+		}
+		if r.name == "max" && n > r.num {
+			return "must not be greater than " + r.arg
+		}
+	case "regex":
+		if v.Kind() == reflect.String && v.Len() != 0 && !r.regex.MatchString(v.String()) {
+			return "must match " + r.arg
+		}
+	case "enum":
+		if isZero(v) {
+			return ""
+		}
+		s := toString(v)
+		for _, e := range r.enum {
+			if e == s {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(r.enum, ", ")
+	}
+	return ""
+}
+
+// number return numeric value of v, for string, slice and map, it's the length
+func number(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func toString(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	}
+	return ""
+}
+
+// setValue convert strings to field value, slice field accept multiple values
+// or comma-seperated single value
+func setValue(v reflect.Value, vals []string) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		if len(vals) == 1 && strings.IndexByte(vals[0], ',') >= 0 {
+			vals = strings.Split(vals[0], ",")
+		}
+
+		slice := reflect.MakeSlice(v.Type(), len(vals), len(vals))
+		for i, s := range vals {
+			if err := setString(slice.Index(i), strings.TrimSpace(s)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+
+	return setString(v, vals[0])
+}
+
+func setString(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerTyp) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch t := v.Type(); {
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Err("must be a duration")
+		}
+		v.SetInt(int64(d))
+		return nil
+	case t == timeType:
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return errors.Err("must be a RFC3339 time")
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.Err("must be a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Err("must be an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Err("must be an unsigned integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return errors.Err("must be a number")
+		}
+		v.SetFloat(n)
+	case reflect.Slice: // []byte
+		v.SetBytes([]byte(s))
+	default:
+		return errors.Err("unsupported type " + v.Type().String())
+	}
+	return nil
+}
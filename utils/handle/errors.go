@@ -1,16 +1,17 @@
 package handle
 
 import (
-	"net/http"
-
-	"github.com/cosiner/gohper/errors"
 	"github.com/cosiner/gohper/utils/httperrs"
 	log "github.com/cosiner/ygo/jsonlog"
 	"github.com/cosiner/zerver"
 )
 
+// Error is the error body before problem details.
+//
+// Deprecated: errors are sent as Problem.
 type Error struct {
-	Error string `json:"error"`
+	Error  string             `json:"error"`
+	Fields zerver.FieldErrors `json:"fields,omitempty"`
 }
 
 var (
@@ -20,29 +21,54 @@ var (
 func Wrap(handle func(zerver.Request, zerver.Response) error) zerver.HandleFunc {
 	return func(req zerver.Request, resp zerver.Response) {
 		if err := handle(req, resp); err != nil {
-			SendErr(resp, err)
+			SendProblem(req, resp, err)
 		}
 	}
 }
 
+// SendErr convert error to Problem and send it as application/problem+json
 func SendErr(resp zerver.Response, err error) {
 	if err == nil {
 		panic("there is no error occurred")
 	}
-	logger := resp.Logger()
-	switch e := errors.Unwrap(err).(type) {
-	case httperrs.Error:
-		resp.StatusCode(e.Code())
-		if logger.IsDebugEnable() {
-			logger.Debug(log.M{"msg": "request error", "error": err.Error()})
-		}
-		if e.Code() < int(httperrs.Server) {
-			resp.Send(Error{e.Error()})
-			return
-		}
-	default:
+
+	sendProblem(resp, ToProblem(err), err)
+}
+
+// SendProblem is same as SendErr, but the problem instance is set to request path
+func SendProblem(req zerver.Request, resp zerver.Response, err error) {
+	if err == nil {
+		panic("there is no error occurred")
+	}
+
+	p := ToProblem(err)
+	if p.Instance == "" {
+		p.Instance = req.URL().Path
+	}
+	sendProblem(resp, p, err)
+}
+
+func sendProblem(resp zerver.Response, p *Problem, err error) {
+	logger := resp.Log()
+	if p.Status >= int(httperrs.Server) {
 		logger.Error(log.M{"msg": "internal server error", "error": err.Error()})
-		resp.StatusCode(http.StatusInternalServerError)
+	} else if logger.IsDebugEnable() {
+		logger.Debug(log.M{"msg": "request error", "error": err.Error()})
+	}
+
+	headers := resp.Headers()
+	if p.TraceID == "" {
+		p.TraceID = headers.Get(TraceIDHeader)
+	}
+	headers.Set(zerver.HEADER_CONTENTTYPE, CONTENTTYPE_PROBLEM)
+	resp.StatusCode(p.Status)
+
+	_, codec := resp.Codecs().Default()
+	if c := resp.Codecs().Get(zerver.MEDIATYPE_JSON); c != nil {
+		codec = c
+	}
+	if err := codec.Encode(resp, p); err != nil {
+		logger.Warn(log.M{"msg": "send problem failed", "error": err.Error()})
 	}
 }
 
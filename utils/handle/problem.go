@@ -0,0 +1,163 @@
+package handle
+
+import (
+	stderrors "errors"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/gohper/utils/httperrs"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	CONTENTTYPE_PROBLEM = "application/problem+json"
+)
+
+// TraceIDHeader is the response header whose value is used as problem trace id,
+// it's the default header of filter.Correlation, not the X-Request-Id of
+// filter.RequestId
+var TraceIDHeader = "X-Correlation-Id"
+
+// Problem is the RFC 7807 problem details, it's also an error, so handlers
+// can return it directly
+type Problem struct {
+	Type     string             `json:"type,omitempty"` // URI reference, "about:blank" if empty
+	Title    string             `json:"title,omitempty"`
+	Status   int                `json:"status"`
+	Detail   string             `json:"detail,omitempty"`
+	Instance string             `json:"instance,omitempty"`
+	Errors   zerver.FieldErrors `json:"errors,omitempty"`
+	TraceID  string             `json:"traceId,omitempty"`
+}
+
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+func (p *Problem) Code() int {
+	return p.Status
+}
+
+// =============================================================================
+//
+//	Registry
+//
+// =============================================================================
+type sentinel struct {
+	err     error
+	problem Problem
+}
+
+var registry = struct {
+	sync.RWMutex
+	sentinels []sentinel
+	types     map[reflect.Type]Problem
+}{
+	types: make(map[reflect.Type]Problem),
+}
+
+// RegisterError map a sentinel error to problem template, if template's title
+// is empty, status text is used, if detail is empty and status < 500,
+// error message is used
+func RegisterError(err error, p Problem) {
+	registry.Lock()
+	registry.sentinels = append(registry.sentinels, sentinel{err: err, problem: p})
+	registry.Unlock()
+}
+
+// RegisterErrorType map all errors has the same type as err to problem template
+func RegisterErrorType(err error, p Problem) {
+	registry.Lock()
+	registry.types[reflect.TypeOf(err)] = p
+	registry.Unlock()
+}
+
+func lookup(err error) (Problem, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for _, s := range registry.sentinels {
+		if stderrors.Is(err, s.err) {
+			return s.problem, true
+		}
+	}
+	p, has := registry.types[reflect.TypeOf(err)]
+	return p, has
+}
+
+// errChain return the error and all errors it wrapped
+func errChain(err error) []error {
+	chain := []error{err}
+	if e := errors.Unwrap(err); e != nil && e != err {
+		chain = append(chain, e)
+		err = e
+	}
+	for e := stderrors.Unwrap(err); e != nil; e = stderrors.Unwrap(e) {
+		chain = append(chain, e)
+	}
+	return chain
+}
+
+// ToProblem convert error to problem: Problem and zerver.FieldErrors are
+// converted directly, then registered errors, then httperrs.Error. Others
+// are 500 without detail.
+func ToProblem(err error) *Problem {
+	chain := errChain(err)
+	for _, e := range chain {
+		switch e := e.(type) {
+		case *Problem:
+			p := *e
+			if p.Status == 0 {
+				p.Status = http.StatusInternalServerError
+			}
+			if p.Title == "" {
+				p.Title = http.StatusText(p.Status)
+			}
+			return &p
+		case zerver.FieldErrors:
+			return &Problem{
+				Title:  "Invalid Parameters",
+				Status: e.Code(),
+				Errors: e,
+			}
+		}
+
+		if p, has := lookup(e); has {
+			return fillProblem(&p, err)
+		}
+	}
+
+	for _, e := range chain {
+		if e, is := e.(httperrs.Error); is {
+			return fillProblem(&Problem{Status: e.Code()}, err)
+		}
+	}
+
+	return fillProblem(&Problem{Status: http.StatusInternalServerError}, err)
+}
+
+func fillProblem(p *Problem, err error) *Problem {
+	if p.Status == 0 {
+		p.Status = http.StatusInternalServerError
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Detail == "" && p.Status < int(httperrs.Server) {
+		p.Detail = err.Error()
+	}
+	return p
+}
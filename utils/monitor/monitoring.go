@@ -5,7 +5,9 @@ import (
 	"net/url"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cosiner/gohper/io2"
@@ -57,6 +59,25 @@ func globalFilter(req zerver.Request, resp zerver.Response, chain zerver.FilterC
 
 var inited bool
 
+var (
+	gauges   = make(map[string]func() int64)
+	gaugesMu sync.RWMutex
+)
+
+// RegisterGauge export a gauge through the "/gauges" endpoint, it can be
+// called at any time
+func RegisterGauge(name string, fn func() int64) {
+	gaugesMu.Lock()
+	gauges[name] = fn
+	gaugesMu.Unlock()
+}
+
+func UnregisterGauge(name string) {
+	gaugesMu.Lock()
+	delete(gauges, name)
+	gaugesMu.Unlock()
+}
+
 func Handle(path, info string, fn zerver.HandleFunc) {
 	infos[path], routes[path] = info, handler.WrapMethodHandler(&getHandler{doGet: fn})
 }
@@ -111,6 +132,20 @@ func initRoutes() bool {
 			pprof.WriteHeapProfile(resp)
 		})
 
+	Handle("/gauges", "Get registered gauges, such as concurrency",
+		func(req zerver.Request, resp zerver.Response) {
+			gaugesMu.RLock()
+			names := make([]string, 0, len(gauges))
+			for name := range gauges {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				io2.WriteString(resp, name+": "+strconv.FormatInt(gauges[name](), 10)+"\n")
+			}
+			gaugesMu.RUnlock()
+		})
+
 	Handle("/routes", "Get all routes",
 		func(req zerver.Request, resp zerver.Response) {
 			req.Server().PrintRouteTree(resp)
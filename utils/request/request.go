@@ -1,30 +1,26 @@
 package request
 
 import (
-	"strings"
-
 	"github.com/cosiner/zerver"
 )
 
+// Deprecated: forwarding headers are configured by ServerOption.TrustedProxies,
+// it's not used any more
 var ProxyHeaders = []string{"X-Forwarded-For"}
 
+// RemoteAddr return client ip of request.
+//
+// Deprecated: use Request.ClientIP, forwarding headers are only trusted from
+// ServerOption.TrustedProxies.
 func RemoteAddr(req zerver.Request) string {
-	for _, header := range ProxyHeaders {
-		addr := req.GetHeader(header)
-		if addr != "" {
-			return strings.Split(addr, ";")[0]
-		}
-	}
-	return req.RemoteAddr()
+	return req.ClientIP()
 }
 
+// ParseIp return ip of address in forms of "ip", "ip:port" or "[ipv6]:port"
 func ParseIp(addr string) string {
-	index := strings.IndexByte(addr, ':')
-	if index < 0 {
+	ip := zerver.ParseIP(addr)
+	if ip == nil {
 		return addr
 	}
-	if index == 0 {
-		return "127.0.0.1"
-	}
-	return addr[:index]
+	return ip.String()
 }
@@ -0,0 +1,248 @@
+package sse
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+	"github.com/cosiner/zerver"
+)
+
+type (
+	// Message is the task value accepted by Hub, publish event to subscribers
+	// of the topic, if topic is empty, event will be sent to all subscribers
+	Message struct {
+		Topic string
+		Event
+	}
+
+	// Hub dispatch events to subscribed streams, it's also a TaskHandler, so
+	// events can be published through Server.StartTask with a Message or
+	// Event(broadcast) as value
+	Hub struct {
+		BufferSize  int           // event buffer size of each subscriber, default 16
+		HistorySize int           // events kept for each topic for Last-Event-ID resume, default 64
+		Heartbeat   time.Duration // heartbeat interval, default 15 seconds, negative to disable
+		// topics without subscribers keep their history for Last-Event-ID resume,
+		// they are removed after idle for IdleTimeout, default 5 minutes
+		IdleTimeout time.Duration
+
+		mu     sync.RWMutex
+		seq    uint64
+		topics map[string]*topic
+		log    *log.Logger
+		stop   chan struct{}
+	}
+
+	topic struct {
+		subs    map[*Subscription]struct{}
+		history []Event
+		active  time.Time // last publish or unsubscribe time
+	}
+
+	Subscription struct {
+		C     <-chan Event
+		c     chan Event
+		topic string
+		hub   *Hub
+	}
+)
+
+func (h *Hub) Init(zerver.Env) error {
+	if h.BufferSize <= 0 {
+		h.BufferSize = 16
+	}
+	if h.HistorySize <= 0 {
+		h.HistorySize = 64
+	}
+	if h.Heartbeat == 0 {
+		h.Heartbeat = 15 * time.Second
+	}
+	if h.IdleTimeout <= 0 {
+		h.IdleTimeout = 5 * time.Minute
+	}
+	h.topics = make(map[string]*topic)
+	h.log = log.Derive("TaskHandler", "SSEHub")
+	h.stop = make(chan struct{})
+	go h.clean()
+	return nil
+}
+
+// Destroy close all subscriptions
+func (h *Hub) Destroy() {
+	close(h.stop)
+
+	h.mu.Lock()
+	for _, t := range h.topics {
+		for sub := range t.subs {
+			close(sub.c)
+		}
+	}
+	h.topics = make(map[string]*topic)
+	h.mu.Unlock()
+}
+
+func (h *Hub) Handle(task zerver.Task) {
+	switch v := task.Value().(type) {
+	case Message:
+		h.Publish(v.Topic, v.Event)
+	case *Message:
+		h.Publish(v.Topic, v.Event)
+	case Event:
+		h.Publish("", v)
+	case *Event:
+		h.Publish("", *v)
+	default:
+		h.log.Warn(log.M{"msg": "unexpected task value", "pattern": task.Pattern()})
+	}
+}
+
+// Subscribe a topic, events after lastID in history will be sent first,
+// if lastID is not found, all history events will be sent
+func (h *Hub) Subscribe(name, lastID string) *Subscription {
+	c := make(chan Event, h.BufferSize+h.HistorySize)
+	sub := &Subscription{
+		C:     c,
+		c:     c,
+		topic: name,
+		hub:   h,
+	}
+
+	h.mu.Lock()
+	t := h.topic(name)
+	if lastID != "" {
+		history := t.history
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].ID == lastID {
+				history = history[i+1:]
+				break
+			}
+		}
+		for _, e := range history {
+			c <- e
+		}
+	}
+	t.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// Publish send event to subscribers of topic, if event id is empty, an
+// increasing id will be assigned. Subscribers can't keep up will be dropped.
+// Events of a topic without subscribers are still kept in history.
+func (h *Hub) Publish(name string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.ID == "" {
+		h.seq++
+		e.ID = strconv.FormatUint(h.seq, 10)
+	}
+
+	if name != "" {
+		h.publish(name, h.topic(name), e)
+		return
+	}
+	for name, t := range h.topics {
+		h.publish(name, t, e)
+	}
+}
+
+func (h *Hub) publish(name string, t *topic, e Event) {
+	if len(t.history) >= h.HistorySize {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:len(t.history)-1]
+	}
+	t.history = append(t.history, e)
+	t.active = time.Now()
+
+	for sub := range t.subs {
+		select {
+		case sub.c <- e:
+		default:
+			delete(t.subs, sub)
+			close(sub.c)
+			h.log.Warn(log.M{"msg": "drop slow subscriber", "topic": name})
+		}
+	}
+}
+
+// clean remove topics without subscribers and idle for IdleTimeout
+func (h *Hub) clean() {
+	ticker := time.NewTicker(h.IdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			for name, t := range h.topics {
+				if len(t.subs) == 0 && now.Sub(t.active) >= h.IdleTimeout {
+					delete(h.topics, name)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// topic must be called with lock held
+func (h *Hub) topic(name string) *topic {
+	t := h.topics[name]
+	if t == nil {
+		t = &topic{
+			subs:   make(map[*Subscription]struct{}),
+			active: time.Now(),
+		}
+		h.topics[name] = t
+	}
+	return t
+}
+
+// Close unsubscribe from hub, it's safe to call multiple times
+func (s *Subscription) Close() {
+	h := s.hub
+	h.mu.Lock()
+	if t := h.topics[s.topic]; t != nil {
+		if _, has := t.subs[s]; has {
+			delete(t.subs, s)
+			close(s.c)
+			t.active = time.Now()
+		}
+	}
+	h.mu.Unlock()
+}
+
+// Serve create a stream for request, subscribe the topic and send events
+// until client disconnected, it's resumable by Last-Event-ID
+func (h *Hub) Serve(req zerver.Request, resp zerver.Response, topic string) error {
+	stream := NewStream(req, resp)
+	sub := h.Subscribe(topic, stream.LastEventID())
+	defer sub.Close()
+
+	heartbeat := h.Heartbeat
+	if heartbeat < 0 {
+		heartbeat = 0
+	}
+	return stream.Serve(sub.C, heartbeat)
+}
+
+// Handler return a HandleFunc serve events of the topic returned by fn,
+// if fn is nil, request pattern will be used as topic
+func (h *Hub) Handler(fn func(zerver.Request) string) zerver.HandleFunc {
+	return func(req zerver.Request, resp zerver.Response) {
+		topic := req.Pattern()
+		if fn != nil {
+			topic = fn(req)
+		}
+
+		err := h.Serve(req, resp, topic)
+		if err != nil && err != ErrClientGone {
+			req.Log().For(h.log).Warn(log.M{"msg": "serve event stream failed", "err": err.Error(), "topic": topic})
+		}
+	}
+}
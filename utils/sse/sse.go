@@ -0,0 +1,178 @@
+package sse
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+)
+
+const (
+	ErrClientGone = errors.Err("sse client disconnected")
+
+	CONTENTTYPE_EVENTSTREAM = "text/event-stream"
+	HEADER_LASTEVENTID      = "Last-Event-ID"
+	// query parameter for clients can't set header, such as EventSource polyfills
+	PARAM_LASTEVENTID = "lastEventId"
+)
+
+type (
+	// Event is a server-sent event, Data can be string, []byte or any value
+	// can be marshaled by server codec
+	Event struct {
+		ID    string
+		Event string
+		Retry time.Duration
+		Data  interface{}
+	}
+
+	// Stream write events to client as text/event-stream
+	Stream struct {
+		req  zerver.Request
+		resp zerver.Response
+		buf  bytes.Buffer
+	}
+)
+
+// NewStream set headers for event stream and flush them to client
+func NewStream(req zerver.Request, resp zerver.Response) *Stream {
+	headers := resp.Headers()
+	headers.Set(zerver.HEADER_CONTENTTYPE, CONTENTTYPE_EVENTSTREAM)
+	headers.Set(zerver.HEADER_CACHECONTROL, "no-cache")
+	headers.Set("Connection", "keep-alive")
+	headers.Set("X-Accel-Buffering", "no") // disable nginx proxy buffering
+	headers.Del(zerver.HEADER_CONTENTLENGTH)
+
+	resp.StatusCode(http.StatusOK)
+	resp.Write(nil) // write status and headers
+	resp.Flush()
+
+	return &Stream{
+		req:  req,
+		resp: resp,
+	}
+}
+
+// LastEventID return the id of last event client received before reconnecting
+func LastEventID(req zerver.Request) string {
+	id := req.GetHeader(HEADER_LASTEVENTID)
+	if id == "" {
+		id = req.Vars().QueryVar(PARAM_LASTEVENTID)
+	}
+	return id
+}
+
+func (s *Stream) LastEventID() string {
+	return LastEventID(s.req)
+}
+
+// Done return a channel closed when client disconnected
+func (s *Stream) Done() <-chan struct{} {
+	return s.req.Context().Done()
+}
+
+// Send write an event and flush it to client
+func (s *Stream) Send(e Event) error {
+	select {
+	case <-s.Done():
+		return ErrClientGone
+	default:
+	}
+
+	buf := &s.buf
+	buf.Reset()
+	if e.ID != "" {
+		writeField(buf, "id", e.ID)
+	}
+	if e.Event != "" {
+		writeField(buf, "event", e.Event)
+	}
+	if e.Retry > 0 {
+		writeField(buf, "retry", strconv.FormatInt(int64(e.Retry/time.Millisecond), 10))
+	}
+
+	var data string
+	switch d := e.Data.(type) {
+	case nil:
+	case string:
+		data = d
+	case []byte:
+		data = string(d)
+	default:
+		bs, err := s.resp.Codec().Marshal(d)
+		if err != nil {
+			return err
+		}
+		data = string(bs)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		writeField(buf, "data", strings.TrimSuffix(line, "\r"))
+	}
+	buf.WriteByte('\n')
+
+	return s.flush()
+}
+
+// Comment write a comment line, it's ignored by client, always used as heartbeat
+func (s *Stream) Comment(comment string) error {
+	buf := &s.buf
+	buf.Reset()
+	for _, line := range strings.Split(comment, "\n") {
+		buf.WriteString(": ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	return s.flush()
+}
+
+// Serve send all events from channel until the channel closed or client
+// disconnected, if heartbeat is positive, a comment will be sent if there is
+// no events in this interval to keep connection alive
+func (s *Stream) Serve(events <-chan Event, heartbeat time.Duration) error {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	done := s.Done()
+	for {
+		select {
+		case <-done:
+			return ErrClientGone
+		case <-tick:
+			if err := s.Comment("heartbeat"); err != nil {
+				return err
+			}
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := s.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Stream) flush() error {
+	_, err := s.resp.Write(s.buf.Bytes())
+	if err == nil {
+		s.resp.Flush()
+	}
+	return err
+}
+
+func writeField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
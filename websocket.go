@@ -22,6 +22,7 @@ type (
 		SetReadDeadline(t time.Time) error
 		SetWriteDeadline(t time.Time) error
 		RemoteAddr() string
+		ClientIP() string
 		URL() *url.URL
 	}
 
@@ -42,6 +43,7 @@ type (
 )
 
 func newWsConn(e Env, conn *websocket.Conn, pattern string, vars *ReqVars) *wsConn {
+	vars.setRequest(conn.Request())
 	return &wsConn{
 		patternString: patternString(pattern),
 		Env:           e,
@@ -67,6 +69,10 @@ func (c *wsConn) RemoteAddr() string {
 	return c.request.RemoteAddr
 }
 
+func (c *wsConn) ClientIP() string {
+	return c.Server().ClientIP(c.request)
+}
+
 // UserAgent return user's agent identify
 func (c *wsConn) UserAgent() string {
 	return c.request.Header.Get(HEADER_USERAGENT)